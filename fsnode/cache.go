@@ -0,0 +1,143 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// DefaultCacheSize is the default number of directory entries kept in the
+// metadata cache.
+const DefaultCacheSize = 10000
+
+// metadataCache keeps the information about the files received listing
+// the directories, so the following lookups don't need to ask the device.
+// Only the files the kernel is using have a node in the inode tree, while
+// the cache keeps the most recently listed entries up to its capacity.
+type metadataCache struct {
+	mu       sync.Mutex
+	capacity int
+
+	// lru contains the entries, the most recently added first
+	lru *list.List
+
+	// dirs indexes the entries by parent ID and name
+	dirs map[string]map[string]*list.Element
+}
+
+type cacheEntry struct {
+	parentID string
+	name     string
+	file     *storage.FileInfo
+	fetched  time.Time
+}
+
+func newMetadataCache(capacity int) *metadataCache {
+	return &metadataCache{
+		capacity: capacity,
+		lru:      list.New(),
+		dirs:     make(map[string]map[string]*list.Element),
+	}
+}
+
+// put adds the file to the cache, evicting the oldest entries if the cache
+// is full.
+func (c *metadataCache) put(parentID string, name string, file *storage.FileInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(parentID, name)
+
+	if c.capacity <= 0 {
+		return
+	}
+
+	for c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back().Value.(*cacheEntry)
+		c.remove(oldest.parentID, oldest.name)
+	}
+
+	entries := c.dirs[parentID]
+	if entries == nil {
+		entries = make(map[string]*list.Element)
+		c.dirs[parentID] = entries
+	}
+
+	entries[name] = c.lru.PushFront(&cacheEntry{
+		parentID: parentID,
+		name:     name,
+		file:     file,
+		fetched:  time.Now(),
+	})
+}
+
+// take removes the file from the cache and returns it with the time it
+// has been received from the device, or nil if it is not in the cache.
+func (c *metadataCache) take(parentID string, name string) (*storage.FileInfo, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.dirs[parentID][name]
+	if !found {
+		return nil, time.Time{}
+	}
+
+	entry := element.Value.(*cacheEntry)
+	c.remove(parentID, name)
+
+	return entry.file, entry.fetched
+}
+
+// dropDir removes the entries of a directory, which is being listed again.
+func (c *metadataCache) dropDir(parentID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, element := range c.dirs[parentID] {
+		c.lru.Remove(element)
+	}
+
+	delete(c.dirs, parentID)
+}
+
+// len returns the number of entries in the cache.
+func (c *metadataCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *metadataCache) remove(parentID string, name string) {
+	entries := c.dirs[parentID]
+
+	element, found := entries[name]
+	if !found {
+		return
+	}
+
+	c.lru.Remove(element)
+	delete(entries, name)
+
+	if len(entries) == 0 {
+		delete(c.dirs, parentID)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+	"github.com/mnencia/mchfuse/storage"
+)
+
+func TestMetadataCache(t *testing.T) {
+	cache := fsnode.NewMetadataCache(3)
+
+	cache.Put("dir1", "a", &storage.FileInfo{ID: "a"})
+	cache.Put("dir1", "b", &storage.FileInfo{ID: "b"})
+	cache.Put("dir2", "c", &storage.FileInfo{ID: "c"})
+	cache.Put("dir2", "d", &storage.FileInfo{ID: "d"})
+
+	if cache.Len() != 3 {
+		t.Errorf("got %v entries, expected 3", cache.Len())
+	}
+
+	// The oldest entry has been evicted
+	if file := cache.Take("dir1", "a"); file != nil {
+		t.Errorf("got %v for an evicted entry", file.ID)
+	}
+
+	// Entries are removed when they are taken
+	if file := cache.Take("dir1", "b"); file == nil || file.ID != "b" {
+		t.Errorf("got %v, expected b", file)
+	}
+
+	if file := cache.Take("dir1", "b"); file != nil {
+		t.Errorf("got %v for an entry already taken", file.ID)
+	}
+
+	cache.DropDir("dir2")
+
+	if cache.Len() != 0 {
+		t.Errorf("got %v entries after dropping the directory, expected 0", cache.Len())
+	}
+}
+
+// TestReaddirplus checks that the lookups and the attributes requested by
+// the kernel for every entry of a listing, like `ls -l` does, are served
+// without contacting the device again.
+func TestReaddirplus(t *testing.T) {
+	const files = 20
+
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	// The listing spans several pages
+	server.PageSize = 8
+
+	dirID := server.AddDirectory(mchtest.RootID, "dir")
+	for i := 0; i < files; i++ {
+		server.AddFile(dirID, fmt.Sprintf("file%02d", i), []byte("content"))
+	}
+
+	// The attributes received with the listing are valid as long as the
+	// kernel caches them
+	root := newRoot(t, server, fsnode.Options{AttrTimeout: time.Minute})
+	ctx := context.Background()
+
+	dir, err := lookup(ctx, root, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.ResetRequests()
+
+	names, err := listNames(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != files {
+		t.Fatalf("listed %q", names)
+	}
+
+	for _, name := range names {
+		file, err := lookup(ctx, dir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out fuse.AttrOut
+		if errno := file.Getattr(ctx, nil, &out); errno != fs.OK {
+			t.Fatal(errno)
+		}
+
+		if out.Size != uint64(len("content")) {
+			t.Errorf("%v has size %v", name, out.Size)
+		}
+	}
+
+	if pages := server.Requests("GET", "/sdk/v2/filesSearch/parents"); pages != 3 {
+		t.Errorf("the listing took %v requests instead of 3", pages)
+	}
+
+	lookups := server.Requests("", "/sdk/v2/filesSearch/parentAndName") + server.Requests("", "/sdk/v2/files/*")
+	if lookups != 0 {
+		t.Errorf("%v requests sent for the lookups of %v entries", lookups, files)
+	}
+}
+
+// TestExpiredListing checks that the entries received listing a directory
+// are not used after AttrTimeout, when the files could have been deleted
+// by another client.
+func TestExpiredListing(t *testing.T) {
+	const attrTimeout = 50 * time.Millisecond
+
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	root := newRoot(t, server, fsnode.Options{AttrTimeout: attrTimeout})
+	ctx := context.Background()
+
+	if _, err := listNames(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client deletes the file after the listing
+	other, err := server.Device()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := other.GetFileByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * attrTimeout)
+
+	if _, err := lookup(ctx, root, "file"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("the lookup of the deleted file returned %v instead of ENOENT", err)
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+const (
+	concurrentWorkers = 8
+	concurrentRounds  = 20
+	concurrentFiles   = 5
+)
+
+// TestConcurrentOperations runs the operations go-fuse calls concurrently
+// on the same nodes. It is meant to be run with the race detector.
+func TestConcurrentOperations(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	// Small pages make the listings span several requests
+	server.PageSize = 2
+
+	dirID := server.AddDirectory(mchtest.RootID, "dir")
+	for i := 0; i < concurrentFiles; i++ {
+		server.AddFile(dirID, fmt.Sprintf("file%d", i), []byte("content"))
+	}
+
+	device, err := server.Device()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFile, err := device.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := fsnode.Unmounted(fsnode.NewMCHNode(device, rootFile.FileInfo(), fsnode.Options{}))
+	fs.NewNodeFS(root, &fs.Options{})
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, concurrentWorkers)
+
+	for worker := 0; worker < concurrentWorkers; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for round := 0; round < concurrentRounds; round++ {
+				name := fmt.Sprintf("file%d", (worker+round)%concurrentFiles)
+				if err := exerciseFile(root, name, worker%2 == 0); err != nil {
+					errs <- fmt.Errorf("worker %d round %d: %w", worker, round, err)
+
+					return
+				}
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentExtendingWrites writes concurrently through different
+// handles past the end of the
+// same file, so most writes fill a hole, which must never overwrite the
+// blocks written by the other ones, and rewrites its first block, which
+// must never make the node forget the size reached by the file.
+func TestConcurrentExtendingWrites(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", nil)
+	root := newRoot(t, server, fsnode.Options{})
+	ctx := context.Background()
+
+	file, err := lookup(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const blockSize = 4
+
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < concurrentWorkers; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			// Every worker writes through its own handle, as different
+			// processes would do
+			fh, _, errno := file.Open(ctx, syscall.O_RDWR)
+			if errno != fs.OK {
+				t.Error(errno)
+
+				return
+			}
+
+			defer fh.(fs.FileReleaser).Release(ctx)
+
+			block := []byte(fmt.Sprintf("%*d", blockSize, worker))
+			if _, errno := fh.(fs.FileWriter).Write(ctx, block, int64(worker*blockSize)); errno != fs.OK {
+				t.Errorf("write block %d: %v", worker, errno)
+			}
+
+			if _, errno := fh.(fs.FileWriter).Write(ctx, []byte("   0"), 0); errno != fs.OK {
+				t.Errorf("rewrite block 0: %v", errno)
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	content, _ := server.Content(id)
+	if len(content) != concurrentWorkers*blockSize {
+		t.Fatalf("content is %q", content)
+	}
+
+	for worker := 0; worker < concurrentWorkers; worker++ {
+		block := fmt.Sprintf("%*d", blockSize, worker)
+		if offset := worker * blockSize; string(content[offset:offset+blockSize]) != block {
+			t.Errorf("block %d is %q", worker, content[offset:offset+blockSize])
+		}
+	}
+
+	if size := file.CachedSize(); size != concurrentWorkers*blockSize {
+		t.Errorf("size is %d instead of %d", size, concurrentWorkers*blockSize)
+	}
+}
+
+// exerciseFile looks up and lists the test directory, then reads and,
+// if write is true, writes the file with the given name.
+func exerciseFile(root *fsnode.MCHNode, name string, write bool) error {
+	ctx := context.Background()
+
+	dir, err := lookup(ctx, root, "dir")
+	if err != nil {
+		return err
+	}
+
+	if err := readdir(ctx, dir); err != nil {
+		return err
+	}
+
+	file, err := lookup(ctx, dir, name)
+	if err != nil {
+		return err
+	}
+
+	var attr fuse.AttrOut
+	if errno := file.Getattr(ctx, nil, &attr); errno != fs.OK {
+		return fmt.Errorf("getattr %s: %w", name, errno)
+	}
+
+	fh, _, errno := file.Open(ctx, syscall.O_RDWR)
+	if errno != fs.OK {
+		return fmt.Errorf("open %s: %w", name, errno)
+	}
+
+	defer fh.(fs.FileReleaser).Release(ctx)
+
+	if write {
+		if _, errno := fh.(fs.FileWriter).Write(ctx, []byte("CONTENT"), 0); errno != fs.OK {
+			return fmt.Errorf("write %s: %w", name, errno)
+		}
+	}
+
+	if _, errno := fh.(fs.FileReader).Read(ctx, make([]byte, 16), 0); errno != fs.OK {
+		return fmt.Errorf("read %s: %w", name, errno)
+	}
+
+	if errno := file.Getattr(ctx, fh, &attr); errno != fs.OK {
+		return fmt.Errorf("getattr %s: %w", name, errno)
+	}
+
+	return nil
+}
+
+func lookup(ctx context.Context, parent *fsnode.MCHNode, name string) (*fsnode.MCHNode, error) {
+	var out fuse.EntryOut
+
+	child, errno := parent.Lookup(ctx, name, &out)
+	if errno != fs.OK {
+		return nil, fmt.Errorf("lookup %s: %w", name, errno)
+	}
+
+	return child.Operations().(*fsnode.MCHNode), nil
+}
+
+func readdir(ctx context.Context, dir *fsnode.MCHNode) error {
+	stream, errno := dir.Readdir(ctx)
+	if errno != fs.OK {
+		return fmt.Errorf("readdir: %w", errno)
+	}
+
+	defer stream.Close()
+
+	count := 0
+
+	for stream.HasNext() {
+		if _, errno := stream.Next(); errno != fs.OK {
+			return fmt.Errorf("readdir: %w", errno)
+		}
+
+		count++
+	}
+
+	if count != concurrentFiles {
+		return fmt.Errorf("readdir returned %d entries instead of %d", count, concurrentFiles)
+	}
+
+	return nil
+}
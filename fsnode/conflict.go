@@ -0,0 +1,232 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// Values accepted by Options.Conflict.
+const (
+	ConflictOff  = "off"
+	ConflictFail = "fail"
+	ConflictSave = "save"
+)
+
+// conflictDateLayout is the format of the date in the names of the
+// conflict copies.
+const conflictDateLayout = "2006-01-02 150405"
+
+// ConflictModes lists the values accepted by Options.Conflict.
+func ConflictModes() []string {
+	return []string{ConflictOff, ConflictFail, ConflictSave}
+}
+
+// modifyFunc is an operation changing a file, which must apply the options
+// to the requests sent to the device.
+type modifyFunc func(file *storage.FileInfo, opts ...storage.Option) error
+
+// conflictName returns the name of the copy of a file saved when it has
+// been changed by another client, like `name (conflict from host date).ext`.
+func conflictName(name string, host string, date time.Time) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+
+	return fmt.Sprintf("%s (conflict from %s %s)%s",
+		strings.TrimSuffix(name, ext), host, date.Format(conflictDateLayout), ext)
+}
+
+// checkConflicts reports whether the changes to the files must be
+// conditional to the ETag known by the filesystem.
+func (mn *MCHNode) checkConflicts() bool {
+	return mn.fsys.options.Conflict == ConflictFail || mn.fsys.options.Conflict == ConflictSave
+}
+
+// modify applies op to the file. If the file handle is given, op is
+// applied using it, otherwise the change is conditional to the last ETag
+// seen by the node, and conflicts make op fail.
+func (mn *MCHNode) modify(f fs.FileHandle, op modifyFunc) error {
+	if mf, ok := f.(*MCHFileHandle); ok && mf.node == mn {
+		return mf.modify(op)
+	}
+
+	return mn.updateFile(func(file *storage.FileInfo) error {
+		if !mn.checkConflicts() {
+			return op(file)
+		}
+
+		etag := file.ETag
+		if err := mn.fsys.modifyIfMatch(file, etag, op); err != nil {
+			return err
+		}
+
+		mn.recordChange(etag, file.ETag)
+
+		return nil
+	})
+}
+
+// expectedETag returns the ETag the file must have to be changed by a
+// handle which has last seen etag. If the handle has seen the file before
+// the last changes made through the node, which is then the only one to
+// have changed it since, that is the ETag of the last change.
+func (mn *MCHNode) expectedETag(etag string) string {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if mn.ownETag != "" && etag == mn.ownBase {
+		return mn.ownETag
+	}
+
+	return etag
+}
+
+// recordChange records a change made through the node to the file, which
+// had the ETag from and now has the ETag to. It returns the ETag the
+// changes made through the node since the last change by another client
+// started from.
+func (mn *MCHNode) recordChange(from string, to string) string {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if mn.ownETag == "" || from != mn.ownETag {
+		mn.ownBase = from
+	}
+
+	mn.ownETag = to
+
+	return mn.ownBase
+}
+
+// modifyIfMatch applies op to the file if its ETag is still etag. The file
+// is updated with the ETag returned by the change or, if the storage
+// doesn't return it, with the current one.
+func (fsys *mchFS) modifyIfMatch(file *storage.FileInfo, etag string, op modifyFunc) error {
+	if err := op(file, storage.IfMatch(etag)); err != nil {
+		return err
+	}
+
+	if file.ETag == "" {
+		return fsys.refresh(file)
+	}
+
+	return nil
+}
+
+// modify applies op to the file the handle writes to. The changes are
+// conditional to the ETag the file had when it has been opened, or after
+// the following changes made through any handle of the node. On conflict,
+// depending on the options, op fails or the handle starts writing to a new
+// copy of the file.
+func (mf *MCHFileHandle) modify(op modifyFunc) error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	if mf.conflictCopy != nil {
+		return op(mf.conflictCopy)
+	}
+
+	node := mf.node
+	if !node.checkConflicts() {
+		return node.updateFile(func(file *storage.FileInfo) error {
+			return op(file)
+		})
+	}
+
+	var etag string
+
+	err := node.updateFile(func(file *storage.FileInfo) error {
+		expected := node.expectedETag(mf.etag)
+		if err := node.fsys.modifyIfMatch(file, expected, op); err != nil {
+			return err
+		}
+
+		etag = node.recordChange(expected, file.ETag)
+
+		return nil
+	})
+	if errors.Is(err, storage.ErrorPreconditionFailed) && node.fsys.options.Conflict == ConflictSave {
+		if mf.conflictCopy, err = node.createConflictCopy(); err != nil {
+			return err
+		}
+
+		return op(mf.conflictCopy)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	mf.etag = etag
+
+	return nil
+}
+
+// createConflictCopy creates a copy of the file, next to the node one,
+// where the local version of the file is saved after a conflict. The copy
+// has the current content of the file, over which the changes not yet
+// written are applied.
+func (mn *MCHNode) createConflictCopy() (*storage.FileInfo, error) {
+	_, parent := mn.Parent()
+	if parent == nil {
+		return nil, fmt.Errorf("%v has no parent: %w", mn.getFile().Name, ErrorInvalidFilesystemStatus)
+	}
+
+	parentNode, ok := parent.Operations().(*MCHNode)
+	if !ok {
+		return nil, fmt.Errorf("got a parent of type %T instead of expected *MCHNode: %w",
+			parent.Operations(), ErrorInvalidFilesystemStatus)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown host"
+	}
+
+	now := time.Now()
+	name := conflictName(mn.getFile().Name, host, now)
+
+	conflictCopy, err := mn.fsys.storage.Create(parentNode.getFile(), name, storage.Meta{MTime: now, CTime: now})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mn.fsys.copyContent(mn.getFile(), conflictCopy); err != nil {
+		if err := mn.fsys.storage.Delete(conflictCopy); err != nil {
+			log.Printf("Error removing the incomplete conflict copy %v: %v", name, err)
+		}
+
+		return nil, err
+	}
+
+	log.Printf("%v has been changed by another client, saving the local version as %v",
+		path.Join("/", mn.Path(nil)), name)
+
+	return conflictCopy, nil
+}
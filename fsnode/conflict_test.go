@@ -0,0 +1,219 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+func TestConflictName(t *testing.T) {
+	date := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	tests := map[string]string{
+		"budget.xlsx":    "budget (conflict from laptop 2021-03-14 150926).xlsx",
+		"notes":          "notes (conflict from laptop 2021-03-14 150926)",
+		".bashrc":        ".bashrc (conflict from laptop 2021-03-14 150926)",
+		"archive.tar.gz": "archive.tar (conflict from laptop 2021-03-14 150926).gz",
+	}
+
+	for name, expected := range tests {
+		if result := fsnode.ConflictName(name, "laptop", date); result != expected {
+			t.Errorf("got %q for %q, expected %q", result, name, expected)
+		}
+	}
+}
+
+func TestConflict(t *testing.T) {
+	tests := []struct {
+		mode     string
+		errno    syscall.Errno
+		original string
+		copy     string
+	}{
+		{mode: fsnode.ConflictFail, errno: syscall.ESTALE, original: "REMOTE6789"},
+		{mode: fsnode.ConflictSave, original: "REMOTE6789", copy: "REMOTE67XY"},
+		{mode: fsnode.ConflictOff, original: "REMOTE67XY"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			server := mchtest.NewServer()
+			defer server.Close()
+
+			id := server.AddFile(mchtest.RootID, "sheet.txt", []byte("0123456789"))
+
+			root := newRoot(t, server, fsnode.Options{Conflict: test.mode})
+			ctx := context.Background()
+
+			node, err := lookup(ctx, root, "sheet.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fh, _, errno := node.Open(ctx, syscall.O_RDWR)
+			if errno != fs.OK {
+				t.Fatal(errno)
+			}
+
+			defer fh.(fs.FileReleaser).Release(ctx)
+
+			writer := fh.(fs.FileWriter)
+
+			// The writes of the handle don't conflict with each other
+			for _, off := range []int64{0, 2} {
+				if _, errno := writer.Write(ctx, []byte("ab"), off); errno != fs.OK {
+					t.Fatalf("write at %d returned %v", off, errno)
+				}
+			}
+
+			// Another client changes the file while the handle is open
+			other, err := server.Device()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := other.GetFileByID(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := file.Write([]byte("REMOTE"), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, errno := writer.Write(ctx, []byte("XY"), 8); errno != test.errno {
+				t.Errorf("conflicting write returned %v instead of %v", errno, test.errno)
+			}
+
+			if content, _ := server.Content(id); string(content) != test.original {
+				t.Errorf("the file contains %q instead of %q", content, test.original)
+			}
+
+			names := server.Names(mchtest.RootID)
+
+			switch {
+			case test.copy == "" && len(names) != 1:
+				t.Errorf("unexpected files %q", names)
+			case test.copy != "":
+				if len(names) != 2 || !strings.HasPrefix(names[0], "sheet (conflict from ") {
+					t.Fatalf("no conflict copy in %q", names)
+				}
+
+				copyFile, _ := server.Stat(names[0])
+				if content, _ := server.Content(copyFile.ID); string(content) != test.copy {
+					t.Errorf("the conflict copy contains %q instead of %q", content, test.copy)
+				}
+			}
+		})
+	}
+}
+
+// TestConflictHandles checks that the changes made through other handles
+// of the same mount are not taken for conflicts, while the ones made by
+// other clients still are.
+func TestConflictHandles(t *testing.T) {
+	for _, mode := range []string{fsnode.ConflictFail, fsnode.ConflictSave} {
+		t.Run(mode, func(t *testing.T) {
+			server := mchtest.NewServer()
+			defer server.Close()
+
+			id := server.AddFile(mchtest.RootID, "sheet.txt", []byte("0123456789"))
+
+			root := newRoot(t, server, fsnode.Options{Conflict: mode})
+			ctx := context.Background()
+
+			node, err := lookup(ctx, root, "sheet.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			open := func() fs.FileWriter {
+				fh, _, errno := node.Open(ctx, syscall.O_RDWR)
+				if errno != fs.OK {
+					t.Fatal(errno)
+				}
+
+				t.Cleanup(func() { fh.(fs.FileReleaser).Release(ctx) })
+
+				return fh.(fs.FileWriter)
+			}
+
+			first, second := open(), open()
+
+			// The handles take turns, and the one opened after the
+			// changes too
+			writes := []struct {
+				writer fs.FileWriter
+				data   string
+				off    int64
+			}{
+				{first, "ab", 0},
+				{second, "cd", 2},
+				{first, "ef", 4},
+				{open(), "gh", 6},
+				{second, "ij", 8},
+			}
+
+			for _, write := range writes {
+				if _, errno := write.writer.Write(ctx, []byte(write.data), write.off); errno != fs.OK {
+					t.Fatalf("write of %q returned %v", write.data, errno)
+				}
+			}
+
+			if content, _ := server.Content(id); string(content) != "abcdefghij" {
+				t.Errorf("the file contains %q", content)
+			}
+
+			if names := server.Names(mchtest.RootID); len(names) != 1 {
+				t.Errorf("unexpected files %q", names)
+			}
+
+			// Another client changes the file
+			other, err := server.Device()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := other.GetFileByID(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := file.Write([]byte("REMOTE"), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			_, errno := first.Write(ctx, []byte("XY"), 8)
+
+			switch {
+			case mode == fsnode.ConflictFail && errno != syscall.ESTALE:
+				t.Errorf("conflicting write returned %v instead of ESTALE", errno)
+			case mode == fsnode.ConflictSave && len(server.Names(mchtest.RootID)) != 2:
+				t.Errorf("no conflict copy in %q", server.Names(mchtest.RootID))
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// dirStream lists the content of a directory while its pages are received
+// from the device, so the first entries are returned without waiting for
+// the whole directory, and updates the children of the node and the
+// metadata cache with them.
+type dirStream struct {
+	ctx  context.Context
+	node *MCHNode
+	dir  *storage.FileInfo
+
+	// pageToken is the token of the next page, and lastPage is set once
+	// the last page has been received
+	pageToken string
+	lastPage  bool
+
+	// entries are the entries received but not returned yet
+	entries []fuse.DirEntry
+
+	// listed contains the names of the entries in the pages received, and
+	// folded maps them in lower case, to report those differing only in case
+	listed map[string]bool
+	folded map[string]string
+
+	// owners maps the valid names of the files to the one with the lowest
+	// ID among those having each name, which is listed with it, and
+	// shared contains the names of more than one file, so their owners
+	// are known to the lookups
+	owners map[string]*storage.FileInfo
+	shared map[string]bool
+
+	done bool
+	err  syscall.Errno
+}
+
+var _ = (fs.DirStream)((*dirStream)(nil))
+
+func newDirStream(ctx context.Context, node *MCHNode) *dirStream {
+	dir := node.getFile()
+
+	// The cached entries are replaced by the ones in the new listing
+	node.fsys.cache.dropDir(dir.ID)
+
+	return &dirStream{
+		ctx:    ctx,
+		node:   node,
+		dir:    dir,
+		listed: make(map[string]bool),
+		folded: make(map[string]string),
+		owners: make(map[string]*storage.FileInfo),
+		shared: make(map[string]bool),
+	}
+}
+
+func (ds *dirStream) HasNext() bool {
+	for len(ds.entries) == 0 && ds.err == 0 && !ds.done {
+		ds.fetchPage()
+	}
+
+	return len(ds.entries) > 0 || ds.err != 0
+}
+
+func (ds *dirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if len(ds.entries) == 0 {
+		return fuse.DirEntry{}, ds.err
+	}
+
+	entry := ds.entries[0]
+	ds.entries = ds.entries[1:]
+
+	return entry, fs.OK
+}
+
+func (ds *dirStream) Close() {}
+
+// fetchPage receives the next page of the directory, updating the children
+// of the node. After the last page, the children which are not on the
+// device anymore are removed, and the local-only ones are listed.
+func (ds *dirStream) fetchPage() {
+	if ds.lastPage {
+		ds.finish()
+
+		return
+	}
+
+	page, pageToken, err := ds.node.fsys.storage.List(ds.dir, ds.pageToken)
+	if err != nil {
+		ds.err = syscall.EIO
+		return
+	}
+
+	ds.pageToken = pageToken
+	ds.lastPage = pageToken == ""
+	form := ds.node.fsys.options.Normalization
+	names := entryNames(page, form)
+
+	for i, name := range names {
+		info := &page[i]
+
+		// The names shared with files in previous pages are given as
+		// the ones in the same page, to the file with the lowest ID
+		if plain := normalizeName(info.Name, form); validName(plain) {
+			owner := ds.owners[plain]
+
+			switch {
+			case name != plain:
+				ds.shared[plain] = true
+			case owner == nil:
+				ds.owners[plain] = info
+			case owner.ID < info.ID:
+				ds.shared[plain] = true
+				name = suffixedName(info, form)
+			default:
+				ds.shared[plain] = true
+				ds.owners[plain] = info
+
+				if !ds.handOver(plain, owner, info) {
+					return
+				}
+
+				continue
+			}
+		}
+
+		if !ds.list(name, info) {
+			return
+		}
+	}
+}
+
+// list adds the file to the entries with the given name, updating the
+// children of the node. It returns false if it fails.
+func (ds *dirStream) list(name string, info *storage.FileInfo) bool {
+	ds.listed[name] = true
+
+	if isUnlinkedName(name) {
+		ds.node.cleanupUnlinked(name, info)
+		return true
+	}
+
+	if ds.node.fsys.isRenamingName(name) || ds.node.excluded(name, info.IsDirectory()) {
+		return true
+	}
+
+	ds.node.warnCaseCollision(ds.folded, name)
+
+	// Only the files in use by the kernel have a node, the others
+	// are cached for the lookups following the listing
+	child := ds.node.GetChild(name)
+	if child == nil {
+		ds.node.fsys.cache.put(ds.dir.ID, name, info)
+		ds.entries = append(ds.entries, fuse.DirEntry{
+			Mode: ds.node.fsys.fileType(info),
+			Name: name,
+		})
+
+		return true
+	}
+
+	if err := ds.node.updateChild(ds.ctx, name, info, time.Now()); err != nil {
+		ds.err = syscall.EIO
+		return false
+	}
+
+	ds.add(name, child)
+
+	return true
+}
+
+// handOver gives the name, already listed with the previous file, to the
+// file with a lower ID found in a later page. The entry returned for the
+// name cannot be changed anymore, so the previous file is listed again
+// with its suffixed name, and the kernel is told to look up the name
+// again. It returns false if it fails.
+func (ds *dirStream) handOver(name string, previous, info *storage.FileInfo) bool {
+	suffixed := suffixedName(previous, ds.node.fsys.options.Normalization)
+
+	if child := ds.node.GetChild(name); child != nil && !isLocal(child) {
+		ds.node.MvChild(name, ds.node.EmbeddedInode(), suffixed, true)
+		ds.node.fsys.notifyEntry(ds.node.EmbeddedInode(), name)
+	}
+
+	if !ds.list(suffixed, previous) {
+		return false
+	}
+
+	if !ds.node.excluded(name, info.IsDirectory()) {
+		ds.node.fsys.cache.put(ds.dir.ID, name, info)
+	}
+
+	return true
+}
+
+func (ds *dirStream) finish() {
+	ds.done = true
+
+	owners := make(map[string]string, len(ds.shared))
+	for name := range ds.shared {
+		owners[name] = ds.owners[name].ID
+	}
+
+	ds.node.fsys.setOwners(ds.dir.ID, owners)
+
+	for name, child := range ds.node.Children() {
+		switch {
+		case isLocal(child):
+			// Local files hide the ones with the same name on the device,
+			// and they have already been listed in that case
+			if !ds.listed[name] {
+				ds.add(name, child)
+			}
+		case !ds.listed[name]:
+			ds.node.RmChild(name)
+		}
+	}
+}
+
+func (ds *dirStream) add(name string, child *fs.Inode) {
+	if child == nil {
+		return
+	}
+
+	ds.entries = append(ds.entries, fuse.DirEntry{
+		Mode: child.Mode(),
+		Name: name,
+		Ino:  child.StableAttr().Ino,
+	})
+}
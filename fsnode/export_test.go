@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// Export internal functions to the tests in the fsnode_test package.
+var (
+	EntryNames   = entryNames   // nolint:gochecknoglobals
+	ConflictName = conflictName // nolint:gochecknoglobals
+)
+
+// MetadataCache exports the metadata cache to the tests.
+type MetadataCache struct {
+	cache *metadataCache
+}
+
+func NewMetadataCache(capacity int) MetadataCache {
+	return MetadataCache{newMetadataCache(capacity)}
+}
+
+func (c MetadataCache) Put(parentID string, name string, file *storage.FileInfo) {
+	c.cache.put(parentID, name, file)
+}
+
+func (c MetadataCache) Take(parentID string, name string) *storage.FileInfo {
+	file, _ := c.cache.take(parentID, name)
+
+	return file
+}
+
+func (c MetadataCache) DropDir(parentID string) {
+	c.cache.dropDir(parentID)
+}
+
+func (c MetadataCache) Len() int {
+	return c.cache.len()
+}
+
+// Unmounted makes the filesystem of the node usable without mounting it,
+// skipping the notifications to the kernel.
+func Unmounted(node *MCHNode) *MCHNode {
+	node.fsys.notifyContent = func(*fs.Inode) {}
+	node.fsys.notifyEntry = func(*fs.Inode, string) {}
+
+	return node
+}
+
+// ContentNotifications makes the filesystem of the node, which must not be
+// mounted, send to the returned channel the nodes whose content is
+// invalidated in the kernel page cache.
+func ContentNotifications(node *MCHNode) <-chan *fs.Inode {
+	notified := make(chan *fs.Inode, 16)
+	node.fsys.notifyContent = func(inode *fs.Inode) { notified <- inode }
+
+	return notified
+}
+
+// SetSaveDelay changes how long after a change the store is saved.
+func (ms *MetadataStore) SetSaveDelay(delay time.Duration) {
+	ms.saveDelay = delay
+}
+
+// FileID returns the ID of the file of the node.
+func (mn *MCHNode) FileID() string {
+	return mn.getFile().ID
+}
+
+// CachedSize returns the size of the file known by the node.
+func (mn *MCHNode) CachedSize() uint64 {
+	return mn.getFile().Size
+}
@@ -18,46 +18,145 @@ package fsnode
 
 import (
 	"context"
+	"errors"
+	"io"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/storage"
 )
 
 type MCHFileHandle struct {
 	fs.FileHandle
 	node *MCHNode
+
+	// mu protects the fields used to detect conflicting changes
+	mu sync.Mutex
+
+	// etag is the ETag of the file as last seen by the handle, or the one
+	// the changes made through the node started from
+	etag string
+
+	// conflictCopy is the file receiving the writes after a conflict
+	conflictCopy *storage.FileInfo
 }
 
 var (
 	_ = (fs.FileWriter)((*MCHFileHandle)(nil))
 	_ = (fs.FileReader)((*MCHFileHandle)(nil))
+	_ = (fs.FileAllocater)((*MCHFileHandle)(nil))
+	_ = (fs.FileReleaser)((*MCHFileHandle)(nil))
+	_ = (fs.FileFlusher)((*MCHFileHandle)(nil))
 )
 
-func (mf *MCHFileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	size := int64(mf.node.file.Size)
-	if off > size {
-		// ENXIO = no such address.
-		return nil, syscall.Errno(int(syscall.ENXIO))
+// newFileHandle returns a new handle for the node, keeping track of it
+// until it is released.
+func (mn *MCHNode) newFileHandle() *MCHFileHandle {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.openHandles++
+
+	etag := mn.getFile().ETag
+	if mn.ownETag != "" && etag == mn.ownETag {
+		etag = mn.ownBase
 	}
 
-	end := off + int64(len(dest))
-	if end > size {
-		dest = dest[:size-off]
+	return &MCHFileHandle{node: mn, etag: etag}
+}
+
+func (mf *MCHFileHandle) Release(ctx context.Context) syscall.Errno {
+	if err := mf.node.releaseFileHandle(); err != nil {
+		return syscall.EIO
 	}
 
-	read, err := mf.node.file.Read(dest, off)
-	if err != nil {
+	return fs.OK
+}
+
+func (mf *MCHFileHandle) Flush(ctx context.Context) syscall.Errno {
+	if err := mf.node.restoreExplicitMTime(mf); err != nil {
+		return syscall.EIO
+	}
+
+	return fs.OK
+}
+
+func (mf *MCHFileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	// The cached size could be stale, so we ask the device anyway,
+	// and let it tell us where the end of the file is
+	oldFile := mf.node.getFile()
+	file := *oldFile
+
+	read, err := mf.node.fsys.storage.Read(&file, dest, off)
+	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, syscall.EIO
 	}
 
+	// Only the size and the ETag are updated by the read, while the other
+	// information could have been changed by concurrent operations
+	_ = mf.node.updateFile(func(current *storage.FileInfo) error {
+		current.Size, current.ETag = file.Size, file.ETag
+
+		return nil
+	})
+
+	mf.node.checkContentChanged(oldFile)
+	mf.node.setAccessTime(time.Now())
+
 	return fuse.ReadResultData(dest[:read]), fs.OK
 }
 
 func (mf *MCHFileHandle) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
-	if err := mf.node.file.Write(data, off); err != nil {
-		return 0, syscall.EIO
+	if mf.node.fsys.options.ReadOnly {
+		return 0, syscall.EROFS
 	}
 
+	err := mf.modify(func(file *storage.FileInfo, opts ...storage.Option) error {
+		return mf.node.fsys.storage.Write(file, data, off, opts...)
+	})
+	if err != nil {
+		return 0, writeErrno(err)
+	}
+
+	mf.node.markWritten()
+
 	return uint32(len(data)), fs.OK
 }
+
+func (mf *MCHFileHandle) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	if mf.node.fsys.options.ReadOnly {
+		return syscall.EROFS
+	}
+
+	// Only the default mode, which extends the file if needed, is supported
+	if mode != 0 {
+		return syscall.EOPNOTSUPP
+	}
+
+	err := mf.modify(func(file *storage.FileInfo, opts ...storage.Option) error {
+		return mf.node.fsys.allocate(file, int64(off+size), opts...)
+	})
+	if err != nil {
+		return writeErrno(err)
+	}
+
+	mf.node.markWritten()
+
+	return fs.OK
+}
+
+func writeErrno(err error) syscall.Errno {
+	if errors.Is(err, storage.ErrorWriteGapTooBig) {
+		return syscall.EFBIG
+	}
+
+	if errors.Is(err, storage.ErrorPreconditionFailed) {
+		return syscall.ESTALE
+	}
+
+	return syscall.EIO
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+func TestRead(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("0123456789"))
+
+	root := newRoot(t, server, fsnode.Options{})
+	notified := fsnode.ContentNotifications(root)
+	ctx := context.Background()
+
+	node, err := lookup(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, _, errno := node.Open(ctx, syscall.O_RDONLY)
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+	defer fh.(fs.FileReleaser).Release(ctx)
+
+	other, err := server.Device()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := other.GetFileByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func() error
+		offset  int64
+		content string
+		size    uint64
+	}{
+		{name: "across the end", offset: 8, content: "89", size: 10},
+		{name: "at the end", offset: 10, size: 10},
+		{
+			name:    "grown by another client",
+			change:  func() error { return file.Write([]byte("abcdef"), 10) },
+			offset:  10,
+			content: "abcd",
+			size:    16,
+		},
+		{
+			name:   "shrunk by another client",
+			change: func() error { return file.Truncate(4) },
+			offset: 6,
+			size:   4,
+		},
+		{name: "unchanged", offset: 0, content: "0123", size: 4},
+	}
+
+	for _, test := range tests {
+		if test.change != nil {
+			if err := test.change(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dest := make([]byte, 4)
+
+		result, errno := fh.(fs.FileReader).Read(ctx, dest, test.offset)
+		if errno != fs.OK {
+			t.Fatalf("%v: read returned %v", test.name, errno)
+		}
+
+		if content, _ := result.Bytes(nil); string(content) != test.content {
+			t.Errorf("%v: read %q instead of %q", test.name, content, test.content)
+		}
+
+		if size := node.CachedSize(); size != test.size {
+			t.Errorf("%v: the size is %v instead of %v", test.name, size, test.size)
+		}
+
+		// The pages cached by the kernel are invalidated only if the
+		// content has been changed by another client
+		select {
+		case inode := <-notified:
+			if test.change == nil {
+				t.Errorf("%v: the content cached by the kernel has been invalidated", test.name)
+			} else if inode != node.EmbeddedInode() {
+				t.Errorf("%v: the content of another node has been invalidated", test.name)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if test.change != nil {
+				t.Errorf("%v: the content cached by the kernel has not been invalidated", test.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrorInvalidFilterRule = errors.New("invalid filter rule")
+	errUnterminatedClass   = errors.New("unterminated character class")
+)
+
+// Filter decides which files are hidden from the filesystem, using
+// rclone-style rules. Each rule is a glob pattern prefixed by `+ ` to
+// include or `- ` to exclude the matching files. The first rule matching
+// the path of a file decides; files not matching any rule are included.
+//
+// A pattern starting with `/` matches the complete path from the mount root,
+// otherwise it matches the final components of the path. A pattern ending
+// with `/` matches only directories. In patterns, `*` matches any sequence
+// of characters except `/`, `**` matches any sequence of characters,
+// `?` matches any single character except `/`, `[...]` matches a character
+// class and `{a,b}` matches any of the alternatives.
+//
+// Empty lines and lines starting with `#` or `;` are ignored, and a line
+// containing only `!` clears the rules before it.
+type Filter struct {
+	rules []filterRule
+}
+
+type filterRule struct {
+	include bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// NewFilter parses the given rules.
+func NewFilter(rules []string) (*Filter, error) {
+	f := &Filter{}
+
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+
+		switch {
+		case rule == "" || strings.HasPrefix(rule, "#") || strings.HasPrefix(rule, ";"):
+			continue
+		case rule == "!":
+			f.rules = nil
+			continue
+		case len(rule) < 3 || (rule[0] != '+' && rule[0] != '-') || rule[1] != ' ':
+			return nil, fmt.Errorf("%q: %w", rule, ErrorInvalidFilterRule)
+		}
+
+		pattern := strings.TrimSpace(rule[2:])
+		dirOnly := strings.HasSuffix(pattern, "/")
+
+		re, err := globToRegexp(strings.TrimSuffix(pattern, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w: %v", rule, ErrorInvalidFilterRule, err)
+		}
+
+		f.rules = append(f.rules, filterRule{include: rule[0] == '+', dirOnly: dirOnly, re: re})
+	}
+
+	return f, nil
+}
+
+// ReadFilterFile reads the filter rules contained in a file, one per line.
+func ReadFilterFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rules = append(rules, scanner.Text())
+	}
+
+	return rules, scanner.Err()
+}
+
+// Excluded reports whether the file at the given path, relative to the
+// mount root, must be hidden.
+func (f *Filter) Excluded(filePath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+
+	filePath = path.Join("/", filePath)
+
+	for _, rule := range f.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.re.MatchString(filePath) {
+			return !rule.include
+		}
+	}
+
+	return false
+}
+
+// globToRegexp converts a filter glob pattern to a regular expression
+// matching complete paths.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var re strings.Builder
+
+	if strings.HasPrefix(pattern, "/") {
+		re.WriteString("^")
+	} else {
+		re.WriteString("(^|/)")
+	}
+
+	inBraces := false
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				re.WriteString(".*")
+				i++
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, errUnterminatedClass
+			}
+
+			re.WriteString(pattern[i : i+end+1])
+			i += end
+		case '{':
+			inBraces = true
+
+			re.WriteString("(")
+		case '}':
+			inBraces = false
+
+			re.WriteString(")")
+		case ',':
+			if inBraces {
+				re.WriteString("|")
+			} else {
+				re.WriteString(",")
+			}
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
+
+// excluded reports whether the child with the given name is hidden by
+// the filter.
+func (mn *MCHNode) excluded(name string, isDir bool) bool {
+	if mn.fsys.options.Filter == nil {
+		return false
+	}
+
+	return mn.fsys.options.Filter.Excluded(path.Join(mn.Path(nil), name), isDir)
+}
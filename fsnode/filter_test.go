@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mnencia/mchfuse/fsnode"
+)
+
+func TestFilter(t *testing.T) {
+	filter, err := fsnode.NewFilter([]string{
+		"# OS junk",
+		"- .DS_Store",
+		"- {Thumbs.db,desktop.ini}",
+		"+ /keep/**",
+		"- *.tmp",
+		"- /cache/",
+		"- **/build/*.o",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"/.DS_Store", false, true},
+		{"/photos/2020/.DS_Store", false, true},
+		{"/photos/2020/.DS_Store.jpg", false, false},
+		{"/photos/Thumbs.db", false, true},
+		{"/desktop.ini", false, true},
+		{"/file.tmp", false, true},
+		{"/keep/file.tmp", false, false},
+		{"/keep/sub/.DS_Store", false, true},
+		{"/cache", true, true},
+		{"/cache", false, false},
+		{"/other/cache", true, false},
+		{"/src/build/main.o", false, true},
+		{"/src/build/main.c", false, false},
+		{"/photos/image.jpg", false, false},
+	}
+
+	for _, test := range tests {
+		if excluded := filter.Excluded(test.path, test.isDir); excluded != test.excluded {
+			t.Errorf("Excluded(%q, %v) = %v; expected %v", test.path, test.isDir, excluded, test.excluded)
+		}
+	}
+}
+
+func TestFilterClear(t *testing.T) {
+	filter, err := fsnode.NewFilter([]string{"- *.tmp", "!", "- *.bak"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filter.Excluded("/file.tmp", false) {
+		t.Error("Rules before '!' have not been cleared")
+	}
+
+	if !filter.Excluded("/file.bak", false) {
+		t.Error("Rules after '!' are not applied")
+	}
+}
+
+func TestFilterInvalidRules(t *testing.T) {
+	for _, rule := range []string{"*.tmp", "x *.tmp", "- [abc", "-"} {
+		if _, err := fsnode.NewFilter([]string{rule}); !errors.Is(err, fsnode.ErrorInvalidFilterRule) {
+			t.Errorf("Rule %q returned error %v instead of ErrorInvalidFilterRule", rule, err)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// DefaultLocalMaxSize is the default maximum size of the files kept in
+// memory.
+const DefaultLocalMaxSize = 64 << 20
+
+// localNode is a file which lives only in the memory of the process and is
+// never uploaded to the device. It is used for the scratch files matching
+// the local patterns and for special files, like FIFOs and sockets.
+type localNode struct {
+	fs.Inode
+
+	// maxSize is the size the data cannot grow beyond
+	maxSize int64
+
+	mu   sync.Mutex
+	data []byte
+	attr fuse.Attr
+}
+
+var (
+	_ = (fs.NodeOpener)((*localNode)(nil))
+	_ = (fs.NodeReader)((*localNode)(nil))
+	_ = (fs.NodeWriter)((*localNode)(nil))
+	_ = (fs.NodeGetattrer)((*localNode)(nil))
+	_ = (fs.NodeSetattrer)((*localNode)(nil))
+)
+
+// attrFiller is implemented by the nodes able to fill the attributes of a
+// lookup response without contacting the device.
+type attrFiller interface {
+	getattr(out *fuse.Attr)
+}
+
+func isLocal(child *fs.Inode) bool {
+	_, ok := child.Operations().(*localNode)
+
+	return ok
+}
+
+// isLocalName reports whether a file with the given name must be kept
+// locally instead of being uploaded to the device.
+func (mn *MCHNode) isLocalName(name string) bool {
+	for _, pattern := range mn.fsys.options.LocalPatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keepLocal reports whether a new regular file with the given name must be
+// kept locally, either because it matches the local patterns or because
+// it is hidden by the filter.
+func (mn *MCHNode) keepLocal(name string) bool {
+	return mn.isLocalName(name) || mn.excluded(name, false)
+}
+
+// newLocalChild adds a local child node with the given name and mode.
+func (mn *MCHNode) newLocalChild(ctx context.Context, name string, mode uint32) (*fs.Inode, *localNode) {
+	now := time.Now()
+	node := &localNode{maxSize: mn.fsys.options.LocalMaxSize}
+	node.attr.Mode = mode
+	node.attr.Owner = fuse.Owner{Uid: mn.fsys.options.UID, Gid: mn.fsys.options.GID}
+	node.attr.SetTimes(&now, &now, &now)
+
+	// The content exists only in the node, which must survive the kernel
+	// forgetting it until the file is removed
+	inode := mn.NewPersistentInode(ctx, node, fs.StableAttr{
+		Mode: mode & syscall.S_IFMT,
+	})
+	mn.AddChild(name, inode, true)
+
+	return inode, node
+}
+
+func (ln *localNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if flags&syscall.O_TRUNC != 0 {
+		ln.mu.Lock()
+		ln.data = ln.data[:0]
+		ln.mu.Unlock()
+	}
+
+	return nil, 0, fs.OK
+}
+
+func (ln *localNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if off >= int64(len(ln.data)) {
+		return fuse.ReadResultData(nil), fs.OK
+	}
+
+	end := off + int64(len(dest))
+	if end > int64(len(ln.data)) {
+		end = int64(len(ln.data))
+	}
+
+	// The data is copied as it could change before the result is sent
+	return fuse.ReadResultData(append([]byte(nil), ln.data[off:end]...)), fs.OK
+}
+
+func (ln *localNode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if errno := ln.resize(off + int64(len(data))); errno != fs.OK {
+		return 0, errno
+	}
+
+	copy(ln.data[off:], data)
+
+	now := time.Now()
+	ln.attr.SetTimes(nil, &now, &now)
+
+	return uint32(len(data)), fs.OK
+}
+
+// resize makes the data at least size bytes long, failing with EFBIG if
+// that is more than the maximum size. It must be called holding the lock.
+func (ln *localNode) resize(size int64) syscall.Errno {
+	if size <= int64(len(ln.data)) {
+		return fs.OK
+	}
+
+	if size > ln.maxSize {
+		return syscall.EFBIG
+	}
+
+	data := make([]byte, size)
+	copy(data, ln.data)
+	ln.data = data
+
+	return fs.OK
+}
+
+func (ln *localNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	ln.getattr(&out.Attr)
+
+	return fs.OK
+}
+
+func (ln *localNode) getattr(out *fuse.Attr) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	*out = ln.attr
+	out.Size = uint64(len(ln.data))
+}
+
+func (ln *localNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	ln.mu.Lock()
+
+	if size, ok := in.GetSize(); ok {
+		switch {
+		case size > uint64(ln.maxSize):
+			ln.mu.Unlock()
+
+			return syscall.EFBIG
+		case int64(size) > int64(len(ln.data)):
+			ln.resize(int64(size))
+		default:
+			ln.data = ln.data[:size]
+		}
+	}
+
+	if mode, ok := in.GetMode(); ok {
+		ln.attr.Mode = ln.attr.Mode&syscall.S_IFMT | mode&0o7777
+	}
+
+	if uid, ok := in.GetUID(); ok {
+		ln.attr.Uid = uid
+	}
+
+	if gid, ok := in.GetGID(); ok {
+		ln.attr.Gid = gid
+	}
+
+	atime, atimeOk := in.GetATime()
+	mtime, mtimeOk := in.GetMTime()
+
+	if atimeOk || mtimeOk {
+		ln.attr.SetTimes(optionalTime(atime, atimeOk), optionalTime(mtime, mtimeOk), nil)
+	}
+
+	ln.mu.Unlock()
+
+	return ln.Getattr(ctx, f, out)
+}
+
+// optionalTime returns a pointer to value if it is set, otherwise nil.
+func optionalTime(value time.Time, ok bool) *time.Time {
+	if !ok {
+		return nil
+	}
+
+	return &value
+}
+
+// renameLocal renames a local file, replacing dest if not nil. If the new
+// name must not be kept local, the content of a regular file is uploaded
+// to the device.
+func (mn *MCHNode) renameLocal(
+	ctx context.Context,
+	src *localNode,
+	name string,
+	newParent *MCHNode,
+	newName string,
+	dest *fs.Inode,
+) syscall.Errno {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if src.attr.Mode&syscall.S_IFMT != syscall.S_IFREG || newParent.keepLocal(newName) {
+		// The local file is kept in memory, so it is not lost if the
+		// replaced one cannot be removed
+		if dest != nil {
+			return newParent.remove(ctx, newName, dest)
+		}
+
+		return fs.OK
+	}
+
+	mtime := time.Unix(int64(src.attr.Mtime), int64(src.attr.Mtimensec))
+	ctime := time.Unix(int64(src.attr.Ctime), int64(src.attr.Ctimensec))
+
+	// The content is uploaded with a hidden name if it must replace
+	// another file, which is removed only once the upload is complete
+	uploadName := newName
+	if dest != nil {
+		uploadName = mn.fsys.renamingName("local-" + strconv.FormatUint(src.StableAttr().Ino, 10))
+	}
+
+	store := mn.fsys.storage
+
+	newFile, err := store.Create(newParent.getFile(), uploadName, storage.Meta{MTime: mtime, CTime: ctime})
+	if err != nil {
+		return syscall.EIO
+	}
+
+	// The local file is kept if the upload fails
+	if err := store.Write(newFile, src.data, 0); err != nil {
+		mn.fsys.discard(newFile, uploadName)
+
+		return syscall.EIO
+	}
+
+	// Writing the content changes the modification time
+	if err := store.SetMeta(newFile, storage.Meta{MTime: mtime}); err != nil {
+		mn.fsys.discard(newFile, uploadName)
+
+		return syscall.EIO
+	}
+
+	if dest != nil {
+		if errno := newParent.replace(ctx, newFile, newName, dest); errno != fs.OK {
+			mn.fsys.discard(newFile, uploadName)
+
+			return errno
+		}
+	}
+
+	// The local file is gone, and the uploaded one will be found by the
+	// next lookup
+	mn.RmChild(name)
+	src.ForgetPersistent()
+
+	return fs.OK
+}
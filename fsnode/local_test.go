@@ -0,0 +1,173 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+func TestRenameLocal(t *testing.T) {
+	unavailable := mchfault.Fault{Status: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name     string
+		existing bool
+		faults   func(existingID string) []mchfault.Rule
+		errno    syscall.Errno
+		// content is the content of "file" on the device, if any
+		content string
+	}{
+		{name: "upload", content: "new content"},
+		{name: "replace", existing: true, content: "new content"},
+		{
+			name: "upload failure",
+			faults: func(string) []mchfault.Rule {
+				return []mchfault.Rule{{Path: "/sdk/v2/files/*/resumable", Fault: unavailable}}
+			},
+			errno: syscall.EIO,
+		},
+		{
+			name: "metadata failure",
+			faults: func(string) []mchfault.Rule {
+				return []mchfault.Rule{{Method: http.MethodPatch, Path: "/sdk/v2/files/*", Fault: unavailable}}
+			},
+			errno: syscall.EIO,
+		},
+		{
+			name:     "replace failure",
+			existing: true,
+			faults: func(existingID string) []mchfault.Rule {
+				return []mchfault.Rule{{Method: http.MethodDelete, Path: "/sdk/v2/files/" + existingID, Fault: unavailable}}
+			},
+			errno:   syscall.EIO,
+			content: "old content",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			server := mchtest.NewServer()
+			defer server.Close()
+
+			var existingID string
+			if test.existing {
+				existingID = server.AddFile(mchtest.RootID, "file", []byte("old content"))
+			}
+
+			var faults []mchfault.Rule
+			if test.faults != nil {
+				faults = test.faults(existingID)
+			}
+
+			root := newRoot(t, server, fsnode.Options{LocalPatterns: []string{"*.tmp"}}, faults...)
+			ctx := context.Background()
+
+			if test.existing {
+				if _, err := lookup(ctx, root, "file"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The local file is created only in memory
+			inode, fh, _, errno := root.Create(ctx, "file.tmp", syscall.O_RDWR, 0o644, &fuse.EntryOut{})
+			if errno != fs.OK {
+				t.Fatal(errno)
+			}
+
+			if _, errno := inode.Operations().(fs.NodeWriter).Write(ctx, fh, []byte("new content"), 0); errno != fs.OK {
+				t.Fatal(errno)
+			}
+
+			if _, found := server.Stat("file.tmp"); found {
+				t.Error("the local file has been created on the device")
+			}
+
+			if errno := root.Rename(ctx, "file.tmp", root, "file", 0); errno != test.errno {
+				t.Errorf("rename returned %v instead of %v", errno, test.errno)
+			}
+
+			// Failures leave nothing behind, and the local file is kept
+			names := server.Names(mchtest.RootID)
+
+			switch {
+			case test.content == "" && len(names) != 0,
+				test.content != "" && (len(names) != 1 || names[0] != "file"):
+				t.Errorf("the device contains %q", names)
+			case test.content != "":
+				file, _ := server.Stat("file")
+				if data, _ := server.Content(file.ID); string(data) != test.content {
+					t.Errorf("file contains %q instead of %q", data, test.content)
+				}
+			}
+
+			if kept := root.GetChild("file.tmp") != nil; kept != (test.errno != fs.OK) {
+				t.Errorf("local file kept: %v", kept)
+			}
+		})
+	}
+}
+
+func TestLocalMaxSize(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	root := newRoot(t, server, fsnode.Options{LocalPatterns: []string{"*.tmp"}, LocalMaxSize: 10})
+	ctx := context.Background()
+
+	inode, fh, _, errno := root.Create(ctx, "file.tmp", syscall.O_RDWR, 0o644, &fuse.EntryOut{})
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	writer := inode.Operations().(fs.NodeWriter)
+
+	if _, errno := writer.Write(ctx, fh, []byte("0123456789"), 0); errno != fs.OK {
+		t.Errorf("write up to the maximum size returned %v", errno)
+	}
+
+	if _, errno := writer.Write(ctx, fh, []byte("X"), 10); errno != syscall.EFBIG {
+		t.Errorf("write beyond the maximum size returned %v instead of EFBIG", errno)
+	}
+
+	setattr := inode.Operations().(fs.NodeSetattrer)
+
+	var out fuse.AttrOut
+
+	if errno := setattr.Setattr(ctx, fh, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_SIZE,
+		Size:  1 << 40,
+	}}, &out); errno != syscall.EFBIG {
+		t.Errorf("extending beyond the maximum size returned %v instead of EFBIG", errno)
+	}
+
+	var attr fuse.AttrOut
+	if errno := inode.Operations().(fs.NodeGetattrer).Getattr(ctx, fh, &attr); errno != fs.OK || attr.Size != 10 {
+		t.Errorf("the local file has size %v (%v)", attr.Size, errno)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDirMode  = 0o755
+	DefaultFileMode = 0o644
+)
+
+// metadataSaveDelay is how long after a change the metadata database is
+// saved, together with the other changes made meanwhile.
+const metadataSaveDelay = time.Second
+
+// Metadata contains the POSIX attributes of a file which cannot be stored
+// on the device.
+type Metadata struct {
+	Mode uint32 `json:"mode"`
+	UID  uint32 `json:"uid"`
+	GID  uint32 `json:"gid"`
+}
+
+// MetadataStore is a local database containing the Metadata of the files,
+// keyed by their ID. The content is kept in memory and persisted as
+// a JSON file shortly after it changes, so the changes made in a burst,
+// e.g. by `chmod -R`, are saved together. Flush must be called before
+// exiting to save the last changes.
+type MetadataStore struct {
+	path      string
+	saveDelay time.Duration
+
+	// saveMu serializes the saves, which are made without holding mu
+	saveMu sync.Mutex
+
+	mu      sync.Mutex
+	entries map[string]Metadata
+
+	// dirty reports whether the entries have changed since the last save,
+	// which is then scheduled by timer
+	dirty bool
+	timer *time.Timer
+
+	// err is the error of the last save, if failed
+	err error
+}
+
+// OpenMetadataStore loads the metadata database stored in the file at the
+// given path. A missing file is an empty database.
+func OpenMetadataStore(path string) (*MetadataStore, error) {
+	ms := &MetadataStore{
+		path:      path,
+		saveDelay: metadataSaveDelay,
+		entries:   make(map[string]Metadata),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ms, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ms.entries); err != nil {
+		return nil, err
+	}
+
+	return ms, nil
+}
+
+// Get returns the metadata stored for the file with the given ID.
+func (ms *MetadataStore) Get(id string) (Metadata, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	md, ok := ms.entries[id]
+
+	return md, ok
+}
+
+// Set stores the metadata for the file with the given ID. It fails if the
+// last save of the database failed.
+func (ms *MetadataStore) Set(id string, md Metadata) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.entries[id] = md
+
+	return ms.changed()
+}
+
+// Delete removes the metadata stored for the file with the given ID. It
+// fails if the last save of the database failed.
+func (ms *MetadataStore) Delete(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.entries[id]; !ok {
+		return nil
+	}
+
+	delete(ms.entries, id)
+
+	return ms.changed()
+}
+
+// changed schedules the save of the changed entries, returning the error
+// of the last save. It must be called holding the lock.
+func (ms *MetadataStore) changed() error {
+	ms.dirty = true
+
+	if ms.timer == nil {
+		ms.timer = time.AfterFunc(ms.saveDelay, func() {
+			if err := ms.Flush(); err != nil {
+				log.Printf("Error saving the metadata database %v: %v", ms.path, err)
+			}
+		})
+	}
+
+	return ms.err
+}
+
+// Flush saves the changes not yet saved.
+func (ms *MetadataStore) Flush() error {
+	ms.saveMu.Lock()
+	defer ms.saveMu.Unlock()
+
+	ms.mu.Lock()
+
+	if ms.timer != nil {
+		ms.timer.Stop()
+		ms.timer = nil
+	}
+
+	if !ms.dirty {
+		ms.mu.Unlock()
+
+		return nil
+	}
+
+	data, err := json.Marshal(ms.entries)
+	ms.dirty = false
+	ms.mu.Unlock()
+
+	if err == nil {
+		err = ms.save(data)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// The changes are saved again by the next save
+	if err != nil {
+		ms.dirty = true
+	}
+
+	ms.err = err
+
+	return err
+}
+
+// save writes the database in a temporary file and then renames it over
+// the previous version, so it is never left half written. Both the file
+// and the directory are synced, so the new version survives a crash.
+func (ms *MetadataStore) save(data []byte) error {
+	dir := filepath.Dir(ms.path)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(ms.path)+".*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), ms.path); err != nil {
+		_ = os.Remove(tmp.Name())
+
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes the changes to the entries of the directory durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+
+		return err
+	}
+
+	return dir.Close()
+}
+
+// metadata returns the POSIX attributes of the node, either from the
+// metadata store or from the defaults set in the options.
+func (mn *MCHNode) metadata() Metadata {
+	options := &mn.fsys.options
+
+	if options.Metadata != nil {
+		if md, ok := options.Metadata.Get(mn.getFile().ID); ok {
+			return md
+		}
+	}
+
+	md := Metadata{
+		UID: options.UID,
+		GID: options.GID,
+	}
+
+	switch {
+	case mn.getFile().IsDirectory():
+		md.Mode = options.DirMode &^ options.Umask
+	case mn.isSymlink():
+		md.Mode = 0o777
+	default:
+		md.Mode = options.FileMode &^ options.Umask
+	}
+
+	return md
+}
+
+// setMetadata stores the changes to mode and ownership requested by
+// the user. The changes are ignored if no metadata store is configured.
+func (mn *MCHNode) setMetadata(mode, uid, gid *uint32) error {
+	store := mn.fsys.options.Metadata
+	if store == nil {
+		return nil
+	}
+
+	md := mn.metadata()
+
+	if mode != nil {
+		md.Mode = *mode & 0o7777
+	}
+
+	if uid != nil {
+		md.UID = *uid
+	}
+
+	if gid != nil {
+		md.GID = *gid
+	}
+
+	return store.Set(mn.getFile().ID, md)
+}
+
+// deleteMetadata removes the node from the metadata store, if any.
+func (mn *MCHNode) deleteMetadata() error {
+	if mn.fsys.options.Metadata == nil {
+		return nil
+	}
+
+	return mn.fsys.options.Metadata.Delete(mn.getFile().ID)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mnencia/mchfuse/fsnode"
+)
+
+func TestMetadataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mchfuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metadata.json")
+
+	store, err := fsnode.OpenMetadataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.Get("id1"); ok {
+		t.Fatal("Empty store contains an entry")
+	}
+
+	expected := fsnode.Metadata{Mode: 0o750, UID: 1000, GID: 100}
+
+	if err := store.Set("id1", expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set("id2", fsnode.Metadata{Mode: 0o600}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete("id2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes are saved together
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the store has been saved before being flushed: %v", err)
+	}
+
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the store to verify the content has been persisted
+	store, err = fsnode.OpenMetadataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md, ok := store.Get("id1"); !ok || md != expected {
+		t.Fatalf("Metadata %v does not equal expected %v", md, expected)
+	}
+
+	if _, ok := store.Get("id2"); ok {
+		t.Fatal("Deleted entry is still present in the store")
+	}
+}
+
+func TestMetadataStoreSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mchfuse-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metadata.json")
+
+	store, err := fsnode.OpenMetadataStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetSaveDelay(10 * time.Millisecond)
+
+	expected := fsnode.Metadata{Mode: 0o750, UID: 1000, GID: 100}
+
+	if err := store.Set("id1", expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes are saved shortly after, without flushing them
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		reopened, err := fsnode.OpenMetadataStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if md, ok := reopened.Get("id1"); ok && md == expected {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the store has not been saved")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// No temporary file is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("the directory contains %v files", len(files))
+	}
+}
@@ -0,0 +1,371 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+// The tests in this file mount the filesystem on top of the fake device,
+// and are skipped where FUSE is not available.
+
+// mountServer mounts the root directory of the fake device in a temporary
+// directory, which is unmounted at the end of the test.
+func mountServer(t *testing.T, server *mchtest.Server) string {
+	t.Helper()
+
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("FUSE not available: %v", err)
+	}
+
+	device, err := server.Device()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFile, err := device.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountPoint, err := ioutil.TempDir("", "mchfuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = os.Remove(mountPoint) })
+
+	sec := time.Second
+	root := fsnode.NewMCHNode(device, rootFile.FileInfo(), fsnode.Options{AttrTimeout: sec})
+
+	// Direct mounts don't need fusermount, which falls back to it anyway
+	fuseServer, err := fs.Mount(mountPoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      "mchtest",
+			Name:        "mchfuse",
+			MaxWrite:    fuse.MAX_KERNEL_WRITE,
+			DirectMount: true,
+		},
+		AttrTimeout:  &sec,
+		EntryTimeout: &sec,
+	})
+	if err != nil {
+		t.Skipf("cannot mount the filesystem: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := fuseServer.Unmount(); err != nil {
+			t.Errorf("unmount: %v", err)
+		}
+	})
+
+	return mountPoint
+}
+
+// checkContent fails the test if the file with the given path on the
+// device doesn't have the expected content.
+func checkContent(t *testing.T, server *mchtest.Server, path string, expected []byte) {
+	t.Helper()
+
+	file, found := server.Stat(path)
+	if !found {
+		t.Errorf("%s not found on the device", path)
+
+		return
+	}
+
+	content, _ := server.Content(file.ID)
+	if !bytes.Equal(content, expected) {
+		t.Errorf("%s has %d bytes on the device instead of the expected %d", path, len(content), len(expected))
+	}
+}
+
+// checkMissing fails the test if the file with the given path exists on
+// the device.
+func checkMissing(t *testing.T, server *mchtest.Server, path string) {
+	t.Helper()
+
+	if _, found := server.Stat(path); found {
+		t.Errorf("%s still exists on the device", path)
+	}
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+
+	return data
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+
+		return err
+	}
+
+	return out.Close()
+}
+
+func TestMountCopyLargeFile(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	mountPoint := mountServer(t, server)
+
+	data := randomData(5<<20 + 123)
+
+	src, err := ioutil.TempFile("", "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(src.Name())
+
+	if _, err := src.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyFile(src.Name(), filepath.Join(mountPoint, "large")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, server, "large", data)
+
+	// The copy back must read the content from the device
+	if err := copyFile(filepath.Join(mountPoint, "large"), filepath.Join(mountPoint, "copy")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, server, "copy", data)
+}
+
+func TestMountDirectories(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	// Small pages make the listings span several requests
+	server.PageSize = 2
+
+	mountPoint := mountServer(t, server)
+
+	if err := os.MkdirAll(filepath.Join(mountPoint, "a", "b", "c"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		path := filepath.Join(mountPoint, "a", "b", fmt.Sprintf("file%d", i))
+		if err := ioutil.WriteFile(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if file, found := server.Stat("a/b/c"); !found || !file.IsDirectory() {
+		t.Errorf("a/b/c is not a directory on the device")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(mountPoint, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 6 {
+		t.Errorf("a/b has %d entries instead of 6", len(entries))
+	}
+
+	if err := os.Remove(filepath.Join(mountPoint, "a")); err == nil {
+		t.Errorf("removing a non empty directory succeeded")
+	}
+
+	if err := os.RemoveAll(filepath.Join(mountPoint, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMissing(t, server, "a")
+
+	if _, err := os.Stat(filepath.Join(mountPoint, "a")); !os.IsNotExist(err) {
+		t.Errorf("stat of removed directory returned %v", err)
+	}
+}
+
+func TestMountRenameOver(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	server.AddFile(mchtest.RootID, "old", []byte("old content"))
+	server.AddFile(mchtest.RootID, "new", []byte("new content"))
+	dirID := server.AddDirectory(mchtest.RootID, "dir")
+	server.AddFile(dirID, "file", []byte("file"))
+	server.AddDirectory(mchtest.RootID, "empty")
+
+	mountPoint := mountServer(t, server)
+
+	// Editors save files writing a new one and renaming it over the old
+	if err := os.Rename(filepath.Join(mountPoint, "new"), filepath.Join(mountPoint, "old")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, server, "old", []byte("new content"))
+	checkMissing(t, server, "new")
+
+	content, err := ioutil.ReadFile(filepath.Join(mountPoint, "old"))
+	if err != nil || string(content) != "new content" {
+		t.Errorf("read %q, %v after rename", content, err)
+	}
+
+	// Directories can replace only empty directories, which os.Rename
+	// refuses to do
+	err = syscall.Rename(filepath.Join(mountPoint, "empty"), filepath.Join(mountPoint, "dir"))
+	if !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rename over a non empty directory returned %v", err)
+	}
+
+	if err := syscall.Rename(filepath.Join(mountPoint, "dir"), filepath.Join(mountPoint, "empty")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, server, "empty/file", []byte("file"))
+	checkMissing(t, server, "dir")
+
+	err = syscall.Rename(filepath.Join(mountPoint, "old"), filepath.Join(mountPoint, "empty"))
+	if !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("rename of a file over a directory returned %v", err)
+	}
+}
+
+func TestMountTimesAndTruncate(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	server.AddFile(mchtest.RootID, "file", []byte("0123456789"))
+
+	mountPoint := mountServer(t, server)
+	path := filepath.Join(mountPoint, "file")
+
+	mtime := time.Date(2020, 3, 14, 15, 9, 26, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if file, _ := server.Stat("file"); !time.Time(file.MTime).Equal(mtime) {
+		t.Errorf("modification time on the device is %v instead of %v", time.Time(file.MTime), mtime)
+	}
+
+	if err := os.Truncate(path, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, server, "file", []byte("0123"))
+
+	if err := os.Truncate(path, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	checkContent(t, server, "file", []byte("0123\x00\x00"))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != 6 {
+		t.Errorf("size is %d instead of 6", info.Size())
+	}
+}
+
+func TestMountConcurrentReadersAndWriters(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	shared := randomData(256 << 10)
+	server.AddFile(mchtest.RootID, "shared", shared)
+
+	mountPoint := mountServer(t, server)
+
+	const workers = 4
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 2*workers)
+
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(2)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			path := filepath.Join(mountPoint, fmt.Sprintf("file%d", worker))
+			if err := ioutil.WriteFile(path, randomData(worker<<16+1), 0o644); err != nil {
+				errs <- err
+			}
+		}(worker)
+
+		go func() {
+			defer wg.Done()
+
+			content, err := ioutil.ReadFile(filepath.Join(mountPoint, "shared"))
+			if err != nil {
+				errs <- err
+			} else if !bytes.Equal(content, shared) {
+				errs <- fmt.Errorf("read %d bytes of the shared file instead of %d", len(content), len(shared))
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for worker := 0; worker < workers; worker++ {
+		checkContent(t, server, fmt.Sprintf("file%d", worker), randomData(worker<<16+1))
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"log"
+	"path"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// Unicode normalization forms accepted by Options.Normalization.
+const (
+	NormalizationNone = "none"
+	NormalizationNFC  = "nfc"
+	NormalizationNFD  = "nfd"
+)
+
+// NormalizationForms lists the values accepted by Options.Normalization.
+func NormalizationForms() []string {
+	return []string{NormalizationNone, NormalizationNFC, NormalizationNFD}
+}
+
+// nameIDSeparator separates the escaped name of a file from its ID in the
+// name given to the files whose name cannot be used as it is, because it is
+// not valid on a POSIX filesystem or because another file in the same
+// directory has the same name.
+const nameIDSeparator = "~mchid-"
+
+// nameEscaper replaces the characters which cannot be part of a file name
+// with similar looking ones.
+var nameEscaper = strings.NewReplacer( // nolint:gochecknoglobals
+	"/", "∕", // DIVISION SLASH
+	"\x00", "�", // REPLACEMENT CHARACTER
+)
+
+// validName reports whether the name can be used as it is on a POSIX filesystem.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// normalizeName applies the given Unicode normalization form to the name.
+func normalizeName(name string, form string) string {
+	switch form {
+	case NormalizationNFC:
+		return norm.NFC.String(name)
+	case NormalizationNFD:
+		return norm.NFD.String(name)
+	default:
+		return name
+	}
+}
+
+// suffixedName returns the name used for a file whose name is invalid or
+// is shared with other files in the same directory. The name contains the
+// ID of the file, so it can be resolved by lookupSuffixedName.
+func suffixedName(file *storage.FileInfo, form string) string {
+	return nameEscaper.Replace(normalizeName(file.Name, form)) + nameIDSeparator + file.ID
+}
+
+// entryNames returns the names used to present the files in the
+// filesystem, in the same order. Valid names used by only one file,
+// after the normalization, are kept as they are. When more than one file
+// has the same name, the one with the lowest ID keeps it, so the result
+// doesn't depend on the order of the files.
+func entryNames(files []storage.FileInfo, form string) []string {
+	normalized := make([]string, len(files))
+	owners := make(map[string]string, len(files))
+
+	for i := range files {
+		normalized[i] = normalizeName(files[i].Name, form)
+
+		owner, found := owners[normalized[i]]
+		if !found || files[i].ID < owner {
+			owners[normalized[i]] = files[i].ID
+		}
+	}
+
+	names := make([]string, len(files))
+
+	for i := range files {
+		if validName(normalized[i]) && owners[normalized[i]] == files[i].ID {
+			names[i] = normalized[i]
+		} else {
+			names[i] = suffixedName(&files[i], form)
+		}
+	}
+
+	return names
+}
+
+// normalize applies the normalization form configured for the filesystem.
+func (mn *MCHNode) normalize(name string) string {
+	return normalizeName(name, mn.fsys.options.Normalization)
+}
+
+// nameVariants returns the names to search on the device for the given
+// one. When the names are normalized, the file could be stored on the
+// device using any normalization form.
+func (mn *MCHNode) nameVariants(name string) []string {
+	variants := []string{name}
+
+	if mn.fsys.options.Normalization == NormalizationNone || mn.fsys.options.Normalization == "" {
+		return variants
+	}
+
+	for _, variant := range []string{norm.NFC.String(name), norm.NFD.String(name)} {
+		if variant != variants[len(variants)-1] && variant != variants[0] {
+			variants = append(variants, variant)
+		}
+	}
+
+	return variants
+}
+
+// warnCaseCollision logs a warning if the name differs only in case from
+// one of the names already seen in the directory, which are kept in seen
+// indexed by their lower case version, as some clients of the device
+// consider them the same file. Each collision is reported once.
+func (mn *MCHNode) warnCaseCollision(seen map[string]string, name string) {
+	folded := strings.ToLower(name)
+
+	other, found := seen[folded]
+	if !found {
+		seen[folded] = name
+		return
+	}
+
+	if mn.fsys.reportCaseCollision(mn.getFile().ID + "/" + folded) {
+		log.Printf("Warning: %v and %v in %v differ only in case",
+			other, name, path.Join("/", mn.Path(nil)))
+	}
+}
+
+// reportCaseCollision returns whether the collision identified by the
+// given key has not been reported yet, marking it as reported.
+func (fsys *mchFS) reportCaseCollision(key string) bool {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.caseCollisions[key] {
+		return false
+	}
+
+	if fsys.caseCollisions == nil {
+		fsys.caseCollisions = make(map[string]bool)
+	}
+
+	fsys.caseCollisions[key] = true
+
+	return true
+}
+
+// lookupSuffixedName returns the file a name built by suffixedName refers
+// to, or nil if the name doesn't refer to a file in this directory.
+func (mn *MCHNode) lookupSuffixedName(name string) (*storage.FileInfo, error) {
+	pos := strings.LastIndex(name, nameIDSeparator)
+	if pos < 0 {
+		return nil, nil
+	}
+
+	info, err := mn.fsys.lookupByID(mn.getFile(), name[pos+len(nameIDSeparator):])
+	if err != nil || info == nil {
+		return nil, err
+	}
+
+	if suffixedName(info, mn.fsys.options.Normalization) != name {
+		return nil, nil
+	}
+
+	return info, nil
+}
+
+// lookupPlainName returns the file presented with the given name, which
+// doesn't contain the ID of the file. If more than one file had the name
+// when the directory was last listed, it is the one given the name in the
+// listing, otherwise it is the one returned by the device.
+func (mn *MCHNode) lookupPlainName(name string) (*storage.FileInfo, error) {
+	dir := mn.getFile()
+
+	if id := mn.fsys.owner(dir.ID, name); id != "" {
+		info, err := mn.fsys.lookupByID(dir, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// The file could have been renamed or deleted since the listing
+		if info != nil && mn.normalize(info.Name) == name {
+			return info, nil
+		}
+	}
+
+	for _, variant := range mn.nameVariants(name) {
+		info, err := mn.fsys.storage.Lookup(dir, variant)
+		if err != nil || info != nil {
+			return info, err
+		}
+	}
+
+	return nil, nil
+}
+
+// setOwners records the names shared by more than one file in the
+// directory, found listing it, with the ID of the file given each name.
+func (fsys *mchFS) setOwners(dirID string, owners map[string]string) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if len(owners) == 0 {
+		delete(fsys.owners, dirID)
+
+		return
+	}
+
+	if fsys.owners == nil {
+		fsys.owners = make(map[string]map[string]string)
+	}
+
+	fsys.owners[dirID] = owners
+}
+
+// owner returns the ID of the file given the name in the last listing of
+// the directory, if the name was shared by more than one file.
+func (fsys *mchFS) owner(dirID string, name string) string {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	return fsys.owners[dirID][name]
+}
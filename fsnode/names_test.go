@@ -0,0 +1,261 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+	"github.com/mnencia/mchfuse/storage"
+)
+
+func TestEntryNames(t *testing.T) {
+	files := []storage.FileInfo{
+		{ID: "id3", Name: "report.txt"},
+		{ID: "id1", Name: "photo.jpg"},
+		{ID: "id2", Name: "report.txt"},
+		{ID: "id4", Name: "a/b"},
+		{ID: "id5", Name: "nul\x00"},
+		{ID: "id6", Name: ".."},
+	}
+
+	expected := []string{
+		"report.txt~mchid-id3",
+		"photo.jpg",
+		"report.txt",
+		"a∕b~mchid-id4",
+		"nul�~mchid-id5",
+		"..~mchid-id6",
+	}
+
+	names := fsnode.EntryNames(files, fsnode.NormalizationNone)
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %q, expected %q", names, expected)
+	}
+
+	// The names must not depend on the order of the files
+	reversed := make([]storage.FileInfo, len(files))
+	for i := range files {
+		reversed[len(files)-1-i] = files[i]
+	}
+
+	for i, name := range fsnode.EntryNames(reversed, fsnode.NormalizationNone) {
+		if name != expected[len(files)-1-i] {
+			t.Errorf("got %q for %v in reversed order, expected %q", name, reversed[i].ID, expected[len(files)-1-i])
+		}
+	}
+}
+
+func TestEntryNamesNormalization(t *testing.T) {
+	files := []storage.FileInfo{
+		{ID: "id1", Name: "cafe\u0301"},
+		{ID: "id2", Name: "caf\u00e9"},
+		{ID: "id3", Name: "re\u0301sume\u0301.txt"},
+	}
+
+	tests := []struct {
+		form     string
+		expected []string
+	}{
+		{fsnode.NormalizationNone, []string{"cafe\u0301", "caf\u00e9", "re\u0301sume\u0301.txt"}},
+		{fsnode.NormalizationNFC, []string{"caf\u00e9", "caf\u00e9~mchid-id2", "r\u00e9sum\u00e9.txt"}},
+		{fsnode.NormalizationNFD, []string{"cafe\u0301", "cafe\u0301~mchid-id2", "re\u0301sume\u0301.txt"}},
+	}
+
+	for _, test := range tests {
+		names := fsnode.EntryNames(files, test.form)
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("got %q with %v normalization, expected %q", names, test.form, test.expected)
+		}
+	}
+}
+
+// listNames returns the sorted names of the entries of the directory.
+func listNames(ctx context.Context, dir *fsnode.MCHNode) ([]string, error) {
+	stream, errno := dir.Readdir(ctx)
+	if errno != fs.OK {
+		return nil, fmt.Errorf("readdir: %w", errno)
+	}
+
+	defer stream.Close()
+
+	var names []string
+
+	for stream.HasNext() {
+		entry, errno := stream.Next()
+		if errno != fs.OK {
+			return nil, fmt.Errorf("readdir: %w", errno)
+		}
+
+		names = append(names, entry.Name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func TestUnlinkDuplicateName(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	firstID := server.AddFile(mchtest.RootID, "file", []byte("first"))
+	secondID := server.AddFile(mchtest.RootID, "file", []byte("second"))
+	thirdID := server.AddFile(mchtest.RootID, "file", []byte("third"))
+
+	root := newRoot(t, server, fsnode.Options{})
+	ctx := context.Background()
+
+	names, err := listNames(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"file", "file~mchid-" + secondID, "file~mchid-" + thirdID}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("listed %q instead of %q", names, expected)
+	}
+
+	// The plain name refers to the file listed with it, whichever file
+	// the device returns looking it up
+	if errno := root.Unlink(ctx, "file"); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if _, found := server.Content(firstID); found {
+		t.Errorf("the file listed as file has not been removed")
+	}
+
+	if errno := root.Unlink(ctx, "file~mchid-"+thirdID); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if content, _ := server.Content(secondID); string(content) != "second" {
+		t.Errorf("the remaining file contains %q", content)
+	}
+
+	if errno := root.Unlink(ctx, "file~mchid-"+thirdID); errno != syscall.ENOENT {
+		t.Errorf("unlinking a removed file returned %v", errno)
+	}
+}
+
+func TestNormalizedOperations(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	coffeeID := server.AddFile(mchtest.RootID, "cafe\u0301", []byte("coffee"))
+	teaID := server.AddFile(mchtest.RootID, "th\u00e9", []byte("tea"))
+
+	root := newRoot(t, server, fsnode.Options{Normalization: fsnode.NormalizationNFC})
+	ctx := context.Background()
+
+	var out fuse.EntryOut
+
+	// The names received are normalized before looking for the files
+	if _, _, _, errno := root.Create(ctx, "caf\u00e9", 0, 0o644, &out); errno != syscall.EEXIST {
+		t.Errorf("creating an existing file with another form returned %v", errno)
+	}
+
+	if errno := root.Rename(ctx, "the\u0301", root, "infusio\u0301n", 0); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if file, _ := server.Stat("infusi\u00f3n"); file.ID != teaID {
+		t.Errorf("the renamed file is not stored with the normalized name")
+	}
+
+	if errno := root.Unlink(ctx, "cafe\u0301"); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if _, found := server.Content(coffeeID); found {
+		t.Errorf("the file has not been removed")
+	}
+
+	_, fh, _, errno := root.Create(ctx, "re\u0301sume\u0301", 0, 0o644, &out)
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	fh.(fs.FileReleaser).Release(ctx)
+
+	if _, found := server.Stat("r\u00e9sum\u00e9"); !found {
+		t.Errorf("the new file is not stored with the normalized name")
+	}
+
+	names, err := listNames(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"infusi\u00f3n", "r\u00e9sum\u00e9"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("listed %q instead of %q", names, expected)
+	}
+}
+
+func TestDuplicateNamesAcrossPages(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	// The files are listed one per page, the newest first
+	server.PageSize = 1
+
+	firstID := server.AddFile(mchtest.RootID, "file", []byte("first"))
+	secondID := server.AddFile(mchtest.RootID, "file", []byte("second"))
+	thirdID := server.AddFile(mchtest.RootID, "file", []byte("third"))
+
+	root := newRoot(t, server, fsnode.Options{})
+	ctx := context.Background()
+
+	// The kernel looks up the first entry before the next page is received
+	if _, err := lookup(ctx, root, "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := listNames(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"file", "file~mchid-" + secondID, "file~mchid-" + thirdID}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("listed %q instead of %q", names, expected)
+	}
+
+	for name, id := range map[string]string{
+		"file":                  firstID,
+		"file~mchid-" + thirdID: thirdID,
+	} {
+		node, err := lookup(ctx, root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if node.FileID() != id {
+			t.Errorf("%v refers to %v instead of %v", name, node.FileID(), id)
+		}
+	}
+}
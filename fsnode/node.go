@@ -20,19 +20,169 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
-	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/storage"
 )
 
+// renameNoReplace is the flag of renameat2 making it fail if the new name
+// already exists.
+const renameNoReplace = 0x1
+
+// renamingPrefix is the prefix of the hidden name given to the files while
+// they are renamed over an existing one. The complete name is
+// `.mchfuse-renaming-<sessionID>-<key>`. Files left behind by other mounts
+// are not hidden, as they are not going to be renamed anymore.
+const renamingPrefix = ".mchfuse-renaming-"
+
 type MCHNode struct {
 	fs.Inode
-	file *mch.File
+	fsys *mchFS
+
+	// fileMu protects file. The information about the file is shared with
+	// the concurrent operations, so it is never changed in place, but
+	// replaced by an updated copy.
+	fileMu sync.RWMutex
+	file   *storage.FileInfo
+
+	// updateMu serializes the updates of file, which include the requests
+	// changing it on the device, so that they are applied one at a time,
+	// each to the result of the previous one
+	updateMu sync.Mutex
+
+	// mu protects the fields tracking the open handles and the timestamps
+	mu          sync.Mutex
+	openHandles int
+	unlinked    bool
+
+	// atime is the last access time, which is not stored on the device
+	atime time.Time
+
+	// explicitMTime is the modification time set while the file is open,
+	// which must be restored on flush if the file is written afterwards
+	explicitMTime *time.Time
+	written       bool
+
+	// fetched is when the file information has been received from the
+	// device as part of a directory listing or a lookup
+	fetched time.Time
+
+	// ownETag is the ETag of the file after the last change made by the
+	// filesystem, and ownBase the one the file had before the changes
+	// made since then without other clients changing it in between, so
+	// the handles which have seen ownBase can check their changes against
+	// ownETag, as the file has been changed only through the node
+	ownETag string
+	ownBase string
+}
+
+// Options contains the settings of the filesystem.
+type Options struct {
+	// Symlinks enables the emulation of symbolic links, which are stored
+	// on the device as regular files containing the link target.
+	Symlinks bool
+
+	// Trash, if set, is where deleted files and directories are moved to,
+	// instead of being permanently removed
+	Trash Trash
+
+	// RootPath is the path on the device of the directory mounted as root,
+	// used to record the origin of the entries moved to the Trash
+	RootPath string
+
+	// LocalPatterns are glob patterns matching the names of the files
+	// which are kept in memory and never uploaded to the device.
+	LocalPatterns []string
+
+	// LocalMaxSize is the maximum size of each file kept in memory, beyond
+	// which writes fail with EFBIG. The default is DefaultLocalMaxSize.
+	LocalMaxSize int64
+
+	// Normalization is the Unicode normalization form (NormalizationNFC
+	// or NormalizationNFD) applied to the names of the files on the device
+	// in listings and lookups, so names stored in a different form by
+	// other clients can be found.
+	Normalization string
+
+	// AttrTimeout is how long the file information received listing a
+	// directory is considered valid. The kernel asks for the attributes of
+	// the entries right after a READDIRPLUS, and they are answered without
+	// contacting the device again.
+	AttrTimeout time.Duration
+
+	// CacheSize is the number of directory entries received listing the
+	// directories which are kept in memory for the following lookups.
+	// Only the files in use by the kernel are in the inode tree. The
+	// default is DefaultCacheSize.
+	CacheSize int
+
+	// Conflict selects how changes made to a file by other clients while
+	// it is open are handled: ConflictFail makes the writes fail with
+	// ESTALE, ConflictSave saves the local version as a new file next to
+	// it. The default, ConflictOff, overwrites the changes.
+	Conflict string
+
+	// Filter, if set, hides the matching files from the filesystem.
+	// Excluded files cannot be created on the device, and new regular
+	// files matching it are kept in memory, like the LocalPatterns ones.
+	Filter *Filter
+
+	// ReadOnly makes every operation which would change the content of
+	// the device fail with EROFS.
+	ReadOnly bool
+
+	// Metadata is an optional store for the POSIX permissions and
+	// ownership of the files. Without it, changes to them are ignored.
+	Metadata *MetadataStore
+
+	// DirMode and FileMode are the permissions of the files without an
+	// entry in the Metadata store, after applying the Umask.
+	DirMode  uint32
+	FileMode uint32
+	Umask    uint32
+
+	// UID and GID are the owner of the files without an entry in the
+	// Metadata store
+	UID uint32
+	GID uint32
+}
+
+// mchFS contains the state shared by all the nodes of a mounted filesystem.
+type mchFS struct {
+	storage storage.Storage
+	options Options
+
+	// sessionID identifies this mount in the names given to the files
+	// unlinked while still open, or being renamed over existing ones
+	sessionID string
+
+	cache *metadataCache
+
+	// notifyContent invalidates the content of a node in the kernel page
+	// cache, and notifyEntry a name in a directory in the kernel dentry
+	// cache, which is possible only when the filesystem is mounted
+	notifyContent func(inode *fs.Inode)
+	notifyEntry   func(parent *fs.Inode, name string)
+
+	mu sync.Mutex
+
+	// caseCollisions contains the names differing only in case which
+	// have already been reported
+	caseCollisions map[string]bool
+
+	// owners maps the ID of the directories having more than one file
+	// with the same name, when last listed, to those names and to the ID
+	// of the file presented with each of them
+	owners map[string]map[string]string
 }
 
 var (
@@ -50,67 +200,135 @@ var (
 	_ = (fs.NodeCreater)((*MCHNode)(nil))
 	_ = (fs.NodeSetattrer)((*MCHNode)(nil))
 	_ = (fs.NodeMknoder)((*MCHNode)(nil))
+	_ = (fs.NodeSymlinker)((*MCHNode)(nil))
+	_ = (fs.NodeReadlinker)((*MCHNode)(nil))
 )
 
-var ErrorInvalidFilesystemStatus = errors.New("invalid filesytem status")
+// Extended attributes of the root of the filesystem reporting the number
+// of nodes in the inode tree and of the entries in the metadata cache.
+const (
+	InodesXattr = "user.mchfuse.inodes"
+	CacheXattr  = "user.mchfuse.cache"
+)
 
-func NewMCHNode(file *mch.File) *MCHNode {
-	return &MCHNode{file: file}
-}
+var ErrorInvalidFilesystemStatus = errors.New("invalid filesytem status")
 
-func (mn *MCHNode) mode() uint32 {
-	if mn.file.IsDirectory() {
-		return fuse.S_IFDIR
+// NewMCHNode returns the root node of a new filesystem exposing the content
+// of the given directory of the storage.
+func NewMCHNode(store storage.Storage, file *storage.FileInfo, options Options) *MCHNode {
+	if options.DirMode == 0 {
+		options.DirMode = DefaultDirMode
 	}
 
-	return fuse.S_IFREG
-}
+	if options.FileMode == 0 {
+		options.FileMode = DefaultFileMode
+	}
 
-func (mn *MCHNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	if err := mn.fetch(ctx); err != nil {
-		return nil, syscall.EIO
+	if options.CacheSize == 0 {
+		options.CacheSize = DefaultCacheSize
 	}
 
-	children := mn.Children()
+	if options.LocalMaxSize == 0 {
+		options.LocalMaxSize = DefaultLocalMaxSize
+	}
 
-	r := make([]fuse.DirEntry, 0, len(children))
-	for k, ch := range children {
-		r = append(r, fuse.DirEntry{
-			Mode: ch.Mode(),
-			Name: k,
-		})
+	return &MCHNode{
+		file: file,
+		fsys: &mchFS{
+			storage:   store,
+			options:   options,
+			sessionID: newSessionID(),
+			cache:     newMetadataCache(options.CacheSize),
+			notifyContent: func(inode *fs.Inode) {
+				inode.NotifyContent(0, 0)
+			},
+			notifyEntry: func(parent *fs.Inode, name string) {
+				// The kernel handles the notification once the operation
+				// in progress on the directory is complete, so it must not
+				// be waited for
+				go parent.NotifyEntry(name)
+			},
+		},
 	}
+}
 
-	return fs.NewListDirStream(r), 0
+// newChild returns a node for the given file sharing the filesystem state
+// with the current node.
+func (mn *MCHNode) newChild(file *storage.FileInfo) *MCHNode {
+	return &MCHNode{file: file, fsys: mn.fsys}
 }
 
-func (mn *MCHNode) fetch(ctx context.Context) error {
-	fileList, err := mn.file.ListDirectory()
-	if err != nil {
+// getFile returns the information about the file, which must not be modified.
+func (mn *MCHNode) getFile() *storage.FileInfo {
+	mn.fileMu.RLock()
+	defer mn.fileMu.RUnlock()
+
+	return mn.file
+}
+
+// setFile replaces the information about the file, waiting for the
+// updates in progress.
+func (mn *MCHNode) setFile(file *storage.FileInfo) {
+	mn.updateMu.Lock()
+	defer mn.updateMu.Unlock()
+
+	mn.storeFile(file)
+}
+
+func (mn *MCHNode) storeFile(file *storage.FileInfo) {
+	mn.fileMu.Lock()
+	defer mn.fileMu.Unlock()
+
+	mn.file = file
+}
+
+// updateFile calls update on a copy of the information about the file,
+// which replaces the current one if update succeeds. The updates of a node
+// are serialized, so the changes sent by update, like writes extending the
+// file, are never based on information about to be replaced by another one.
+func (mn *MCHNode) updateFile(update func(file *storage.FileInfo) error) error {
+	mn.updateMu.Lock()
+	defer mn.updateMu.Unlock()
+
+	file := *mn.getFile()
+
+	if err := update(&file); err != nil {
 		return err
 	}
 
-	for name := range mn.Children() {
-		if _, found := fileList[name]; !found {
-			mn.RmChild(name)
-		}
+	mn.storeFile(&file)
+
+	return nil
+}
+
+func (mn *MCHNode) mode() uint32 {
+	return mn.fsys.fileType(mn.getFile())
+}
+
+// fileType returns the type bits of the mode of a file.
+func (fsys *mchFS) fileType(file *storage.FileInfo) uint32 {
+	if file.IsDirectory() {
+		return fuse.S_IFDIR
 	}
 
-	for name, info := range fileList {
-		// Pin the variable
-		info := info
-		if err := mn.updateChild(ctx, name, &info); err != nil {
-			return err
-		}
+	if fsys.isSymlink(file) {
+		return fuse.S_IFLNK
 	}
 
-	return nil
+	return fuse.S_IFREG
+}
+
+func (mn *MCHNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return newDirStream(ctx, mn), fs.OK
 }
 
 func (mn *MCHNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	// The children are kept with their normalized names
+	name = mn.normalize(name)
+
 	child := mn.GetChild(name)
 	if child == nil {
-		if err := mn.lookup(ctx, name); err != nil {
+		if err := mn.lookupCached(ctx, name); err != nil {
 			return nil, syscall.EIO
 		}
 
@@ -120,43 +338,99 @@ func (mn *MCHNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 		}
 	}
 
-	if childNode, ok := child.Operations().(*MCHNode); ok {
+	if childNode, ok := child.Operations().(attrFiller); ok {
 		childNode.getattr(&out.Attr)
 	}
 
 	return child, fs.OK
 }
 
-func (mn *MCHNode) lookup(ctx context.Context, name string) error {
-	info, err := mn.file.LookupDirectory(name)
-	if err != nil {
-		return err
+// lookupCached adds to the tree the child with the given name, using the
+// information received listing the directory if it is still valid, as the
+// file could have been changed or deleted by another client since then.
+func (mn *MCHNode) lookupCached(ctx context.Context, name string) error {
+	info, fetched := mn.fsys.cache.take(mn.getFile().ID, name)
+	if info != nil && time.Since(fetched) < mn.fsys.options.AttrTimeout {
+		return mn.updateChild(ctx, name, info, fetched)
+	}
+
+	_, err := mn.lookup(ctx, name)
+
+	return err
+}
+
+// lookup updates the child with the given name, after the normalization,
+// with the current state of the file on the device, adding or removing it
+// as needed. It returns the normalized name, which is the one to be used
+// for the child, so every operation receiving a name from the kernel must
+// look it up first.
+func (mn *MCHNode) lookup(ctx context.Context, name string) (string, error) {
+	name = mn.normalize(name)
+
+	// Files unlinked while open are not part of the filesystem anymore,
+	// and the ones being renamed are not yet
+	if isUnlinkedName(name) || mn.fsys.isRenamingName(name) {
+		return name, nil
 	}
 
+	// The device is going to tell the current state of the file
+	mn.fsys.cache.take(mn.getFile().ID, name)
+
 	child := mn.GetChild(name)
 
+	// Local files hide the ones with the same name on the device
+	if child != nil && isLocal(child) {
+		return name, nil
+	}
+
+	// Names containing the ID of the file are given to files which cannot
+	// be presented with their own name
+	info, err := mn.lookupSuffixedName(name)
+	if err != nil {
+		return name, err
+	}
+
+	if info == nil {
+		if info, err = mn.lookupPlainName(name); err != nil {
+			return name, err
+		}
+	}
+
+	// Files hidden by the filter are treated as not existing
+	if info != nil && mn.excluded(name, info.IsDirectory()) {
+		info = nil
+	}
+
 	// If the target doesn't exist, make sure it is not present in the cache and return
 	if info == nil {
 		if child != nil {
 			mn.RmChild(name)
 		}
 
-		return nil
+		return name, nil
 	}
 
-	if err := mn.updateChild(ctx, name, info); err != nil {
-		return err
+	if err := mn.updateChild(ctx, name, info, time.Now()); err != nil {
+		return name, err
 	}
 
-	return nil
+	return name, nil
 }
 
-func (mn *MCHNode) updateChild(ctx context.Context, name string, info *mch.File) error {
+// updateChild updates the child with the given name with the information
+// received from the device at the fetched time, adding it if needed.
+func (mn *MCHNode) updateChild(ctx context.Context, name string, info *storage.FileInfo, fetched time.Time) error {
 	child := mn.GetChild(name)
 
+	// Local files hide the ones with the same name on the device
+	if child != nil && isLocal(child) {
+		return nil
+	}
+
 	// If the target exists and we do not have it in cache, add it
 	if child == nil {
-		childNode := NewMCHNode(info)
+		childNode := mn.newChild(info)
+		childNode.setFetched(fetched)
 		mn.AddChild(name,
 			mn.NewInode(ctx, childNode, fs.StableAttr{
 				Mode: childNode.mode(),
@@ -168,8 +442,11 @@ func (mn *MCHNode) updateChild(ctx context.Context, name string, info *mch.File)
 
 	// Compare the content of the cache
 	if childNode, ok := child.Operations().(*MCHNode); ok {
-		if !reflect.DeepEqual(childNode.file, info) {
-			childNode.file = info
+		childNode.setFetched(fetched)
+
+		if oldFile := childNode.getFile(); !reflect.DeepEqual(oldFile, info) {
+			childNode.setFile(info)
+			childNode.checkContentChanged(oldFile)
 		}
 	} else {
 		return fmt.Errorf("got a child of type %T instead of expected *MCHNode: %w",
@@ -180,42 +457,139 @@ func (mn *MCHNode) updateChild(ctx context.Context, name string, info *mch.File)
 }
 
 func (mn *MCHNode) Getattr(ctx context.Context, file fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	if err := mn.file.Refresh(); err != nil {
+	// The information from a recent listing is still valid
+	if mn.recentlyFetched() {
+		mn.getattr(&out.Attr)
+
+		return fs.OK
+	}
+
+	return mn.refreshAttr(out)
+}
+
+// refreshAttr fills out with the attributes of the file, as currently
+// stored on the device.
+func (mn *MCHNode) refreshAttr(out *fuse.AttrOut) syscall.Errno {
+	oldFile := mn.getFile()
+
+	if err := mn.updateFile(mn.fsys.refresh); err != nil {
 		return syscall.EIO
 	}
 
+	mn.checkContentChanged(oldFile)
+
 	mn.getattr(&out.Attr)
 
 	return fs.OK
 }
 
-func (mn *MCHNode) getattr(out *fuse.Attr) {
-	if mn.file.IsDirectory() {
-		out.Mode = 0o755
-	} else {
-		out.Mode = 0o644
+// setFetched records when the file information has been received from
+// the device.
+func (mn *MCHNode) setFetched(fetched time.Time) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.fetched = fetched
+}
+
+// recentlyFetched reports whether the file information has been received
+// from the device less than AttrTimeout ago.
+func (mn *MCHNode) recentlyFetched() bool {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	return !mn.fetched.IsZero() && time.Since(mn.fetched) < mn.fsys.options.AttrTimeout
+}
+
+// checkContentChanged invalidates the kernel page cache for the node if the
+// size or the ETag of the file are different from the ones of oldFile,
+// which means the content has been changed by another client.
+func (mn *MCHNode) checkContentChanged(oldFile *storage.FileInfo) {
+	file := mn.getFile()
+	if file.IsDirectory() {
+		return
+	}
+
+	if file.Size == oldFile.Size && file.ETag == oldFile.ETag {
+		return
 	}
 
-	out.Size = mn.file.Size
-	mtime := time.Time(mn.file.MTime)
-	ctime := time.Time(mn.file.CTime)
-	out.SetTimes(&mtime, &mtime, &ctime)
+	// The notification is sent asynchronously, as the kernel could be
+	// holding locks on the pages involved in the request we are serving
+	go mn.fsys.notifyContent(mn.EmbeddedInode())
 }
 
+func (mn *MCHNode) getattr(out *fuse.Attr) {
+	md := mn.metadata()
+	out.Mode = md.Mode
+	out.Owner = fuse.Owner{Uid: md.UID, Gid: md.GID}
+
+	out.Size = mn.getFile().Size
+	mtime := mn.getFile().MTime
+	ctime := mn.getFile().CTime
+	atime := mn.accessTime()
+	out.SetTimes(&atime, &mtime, &ctime)
+}
+
+// Getxattr exposes on the root of the filesystem the number of nodes in
+// the inode tree and of the entries in the metadata cache, to monitor the
+// memory usage.
 func (mn *MCHNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
-	return 0, syscall.ENOSYS
+	if !mn.IsRoot() {
+		return 0, syscall.ENODATA
+	}
+
+	var value string
+
+	switch attr {
+	case InodesXattr:
+		value = strconv.Itoa(countInodes(mn.EmbeddedInode()))
+	case CacheXattr:
+		value = strconv.Itoa(mn.fsys.cache.len())
+	default:
+		return 0, syscall.ENODATA
+	}
+
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+
+	return uint32(copy(dest, value)), fs.OK
+}
+
+// countInodes returns the number of inodes in the tree rooted in inode.
+func countInodes(inode *fs.Inode) int {
+	count := 1
+	for _, child := range inode.Children() {
+		count += countInodes(child)
+	}
+
+	return count
 }
 
 func (mn *MCHNode) Setxattr(ctx context.Context, attr string, dest []byte, flags uint32) syscall.Errno {
+	if mn.fsys.options.ReadOnly {
+		return syscall.EROFS
+	}
+
 	return syscall.ENOSYS
 }
 
 func (mn *MCHNode) Open(ctx context.Context, flags uint32) (file fs.FileHandle, fuseFlags uint32, code syscall.Errno) {
-	return &MCHFileHandle{node: mn}, 0, fs.OK
+	if mn.fsys.options.ReadOnly && flags&(syscall.O_ACCMODE|syscall.O_TRUNC) != syscall.O_RDONLY {
+		return nil, 0, syscall.EROFS
+	}
+
+	return mn.newFileHandle(), 0, fs.OK
 }
 
 func (mn *MCHNode) Unlink(ctx context.Context, name string) syscall.Errno {
-	if err := mn.lookup(ctx, name); err != nil {
+	if mn.fsys.options.ReadOnly {
+		return syscall.EROFS
+	}
+
+	name, err := mn.lookup(ctx, name)
+	if err != nil {
 		return syscall.EIO
 	}
 
@@ -224,8 +598,21 @@ func (mn *MCHNode) Unlink(ctx context.Context, name string) syscall.Errno {
 		return syscall.ENOENT
 	}
 
-	childNode := child.Operations().(*MCHNode)
-	if err := childNode.file.Delete(); err != nil {
+	childNode, ok := child.Operations().(*MCHNode)
+	if !ok {
+		// Local files only need to be removed from the tree
+		mn.RmChild(name)
+		child.ForgetPersistent()
+		return 0
+	}
+
+	if mn.trashEnabled() {
+		err = mn.moveToTrash(childNode, name)
+	} else {
+		err = childNode.unlink(mn.getFile())
+	}
+
+	if err != nil {
 		return syscall.EIO
 	}
 
@@ -235,7 +622,12 @@ func (mn *MCHNode) Unlink(ctx context.Context, name string) syscall.Errno {
 }
 
 func (mn *MCHNode) Rmdir(ctx context.Context, name string) syscall.Errno {
-	if err := mn.lookup(ctx, name); err != nil {
+	if mn.fsys.options.ReadOnly {
+		return syscall.EROFS
+	}
+
+	name, err := mn.lookup(ctx, name)
+	if err != nil {
 		return syscall.EIO
 	}
 
@@ -244,13 +636,35 @@ func (mn *MCHNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return syscall.ENOENT
 	}
 
-	childNode := child.Operations().(*MCHNode)
+	childNode, ok := child.Operations().(*MCHNode)
+	if !ok || !childNode.getFile().IsDirectory() {
+		return syscall.ENOTDIR
+	}
+
+	// Deleting a directory on the device removes its whole content,
+	// so we must be sure it is empty
+	var empty bool
 
-	if childNode.file.ChildCount > 0 {
+	err = childNode.updateFile(func(file *storage.FileInfo) (err error) {
+		empty, err = mn.fsys.isEmpty(file)
+
+		return err
+	})
+	if err != nil {
+		return syscall.EIO
+	}
+
+	if !empty {
 		return syscall.ENOTEMPTY
 	}
 
-	if err := childNode.file.Delete(); err != nil {
+	if mn.trashEnabled() {
+		err = mn.moveToTrash(childNode, name)
+	} else {
+		err = childNode.delete()
+	}
+
+	if err != nil {
 		return syscall.EIO
 	}
 
@@ -266,43 +680,164 @@ func (mn *MCHNode) Rename(
 	newName string,
 	flags uint32,
 ) syscall.Errno {
+	if mn.fsys.options.ReadOnly {
+		return syscall.EROFS
+	}
+
 	if flags&fs.RENAME_EXCHANGE > 0 {
 		return syscall.EINVAL
 	}
 
-	if err := mn.lookup(ctx, name); err != nil {
+	srcName, err := mn.lookup(ctx, name)
+	if err != nil {
 		return syscall.EIO
 	}
 
-	src := mn.GetChild(name)
+	src := mn.GetChild(srcName)
 	if src == nil {
 		return syscall.ENOENT
 	}
 
-	srcNode, ok := src.Operations().(*MCHNode)
-	if !ok {
-		return syscall.ENOSYS
-	}
-
 	newParentNode, ok := newParent.(*MCHNode)
 	if !ok {
 		return syscall.ENOSYS
 	}
 
-	if err := newParentNode.lookup(ctx, newName); err != nil {
+	destName, err := newParentNode.lookup(ctx, newName)
+	if err != nil {
 		return syscall.EIO
 	}
 
-	dest := newParentNode.GetChild(newName)
+	errno := mn.rename(ctx, src, srcName, newParentNode, destName, flags)
+
+	// The child is moved in the tree with the names received from the
+	// kernel, while the children are kept with the normalized ones
+	if errno == fs.OK && (srcName != name || destName != newName) {
+		mn.MvChild(srcName, newParentNode.EmbeddedInode(), destName, true)
+	}
+
+	return errno
+}
+
+// rename renames the src child, with the given name, to newName in
+// newParent.
+func (mn *MCHNode) rename(
+	ctx context.Context,
+	src *fs.Inode,
+	name string,
+	newParent *MCHNode,
+	newName string,
+	flags uint32,
+) syscall.Errno {
+	dest := newParent.GetChild(newName)
 	if dest != nil {
+		// Renaming a file to itself does nothing
+		if dest == src {
+			return fs.OK
+		}
+
+		if errno := checkReplace(src, dest, flags); errno != fs.OK {
+			return errno
+		}
+	}
+
+	switch srcNode := src.Operations().(type) {
+	case *MCHNode:
+		if newParent.excluded(newName, srcNode.getFile().IsDirectory()) {
+			return syscall.EPERM
+		}
+
+		if dest != nil {
+			return mn.renameOver(ctx, srcNode, newParent, newName, dest)
+		}
+
+		if err := mn.fsys.storage.Rename(srcNode.getFile(), newParent.getFile(), newName); err != nil {
+			return syscall.EIO
+		}
+	case *localNode:
+		return mn.renameLocal(ctx, srcNode, name, newParent, newName, dest)
+	default:
+		return syscall.ENOSYS
+	}
+
+	return fs.OK
+}
+
+// renamingName returns the hidden name of a file while it is renamed over
+// an existing one, where key identifies the file in this mount.
+func (fsys *mchFS) renamingName(key string) string {
+	return fmt.Sprintf("%s%s-%s", renamingPrefix, fsys.sessionID, key)
+}
+
+func (fsys *mchFS) isRenamingName(name string) bool {
+	return strings.HasPrefix(name, renamingPrefix+fsys.sessionID+"-")
+}
+
+// checkReplace returns the error of a rename of src over the existing dest.
+func checkReplace(src, dest *fs.Inode, flags uint32) syscall.Errno {
+	switch {
+	case flags&renameNoReplace > 0:
 		return syscall.EEXIST
+	case dest.IsDir() && !src.IsDir():
+		return syscall.EISDIR
+	case !dest.IsDir() && src.IsDir():
+		return syscall.ENOTDIR
+	default:
+		return fs.OK
 	}
+}
 
-	if err := srcNode.file.Rename(newParentNode.file, newName); err != nil {
+// renameOver renames src over the existing dest child of newParent. As the
+// device cannot rename over a file, src is first moved to a hidden name in
+// newParent, and it is moved back if dest cannot be replaced.
+func (mn *MCHNode) renameOver(
+	ctx context.Context,
+	src *MCHNode,
+	newParent *MCHNode,
+	newName string,
+	dest *fs.Inode,
+) syscall.Errno {
+	store := mn.fsys.storage
+	file := src.getFile()
+	oldName := file.Name
+
+	if err := store.Rename(file, newParent.getFile(), mn.fsys.renamingName(file.ID)); err != nil {
 		return syscall.EIO
 	}
 
-	return 0
+	if errno := newParent.replace(ctx, file, newName, dest); errno != fs.OK {
+		if err := store.Rename(file, mn.getFile(), oldName); err != nil {
+			log.Printf("Error moving back %v after a failed rename: %v", oldName, err)
+		}
+
+		return errno
+	}
+
+	return fs.OK
+}
+
+// replace removes the dest child with the given name, and gives the name to
+// file, which has already been moved to a hidden name in this directory.
+// The file is left with the hidden name if it fails.
+func (mn *MCHNode) replace(ctx context.Context, file *storage.FileInfo, name string, dest *fs.Inode) syscall.Errno {
+	if errno := mn.remove(ctx, name, dest); errno != fs.OK {
+		return errno
+	}
+
+	if err := mn.fsys.storage.Rename(file, mn.getFile(), name); err != nil {
+		return syscall.EIO
+	}
+
+	return fs.OK
+}
+
+// remove removes the child with the given name, which can be a directory.
+func (mn *MCHNode) remove(ctx context.Context, name string, child *fs.Inode) syscall.Errno {
+	if child.IsDir() {
+		return mn.Rmdir(ctx, name)
+	}
+
+	return mn.Unlink(ctx, name)
 }
 
 func (mn *MCHNode) Mkdir(
@@ -314,7 +849,13 @@ func (mn *MCHNode) Mkdir(
 	newInode *fs.Inode,
 	errno syscall.Errno,
 ) {
-	if err := mn.lookup(ctx, name); err != nil {
+	if mn.fsys.options.ReadOnly {
+		errno = syscall.EROFS
+		return
+	}
+
+	name, err := mn.lookup(ctx, name)
+	if err != nil {
 		errno = syscall.EIO
 		return
 	}
@@ -324,13 +865,18 @@ func (mn *MCHNode) Mkdir(
 		return
 	}
 
-	newFile, err := mn.file.CreateDirectory(name)
+	if mn.excluded(name, true) {
+		errno = syscall.EPERM
+		return
+	}
+
+	newFile, err := mn.fsys.storage.Mkdir(mn.getFile(), name)
 	if err != nil {
 		errno = syscall.EIO
 		return
 	}
 
-	newNode := NewMCHNode(newFile)
+	newNode := mn.newChild(newFile)
 	newInode = mn.NewInode(ctx, newNode, fs.StableAttr{
 		Mode: newNode.mode(),
 	})
@@ -360,7 +906,12 @@ func (mn *MCHNode) Create(
 	fuseFlags uint32,
 	errno syscall.Errno,
 ) {
-	if err := mn.lookup(ctx, name); err != nil {
+	if mn.fsys.options.ReadOnly {
+		return nil, nil, 0, syscall.EROFS
+	}
+
+	name, err := mn.lookup(ctx, name)
+	if err != nil {
 		return nil, nil, 0, syscall.EIO
 	}
 
@@ -368,12 +919,31 @@ func (mn *MCHNode) Create(
 		return nil, nil, 0, syscall.EEXIST
 	}
 
-	newFile, err := mn.file.Create(name)
+	if mn.keepLocal(name) {
+		newInode, newNode := mn.newLocalChild(ctx, name, syscall.S_IFREG|mode&0o7777)
+		newNode.getattr(&out.Attr)
+
+		return newInode, nil, 0, fs.OK
+	}
+
+	newInode, newNode, errno := mn.createFile(ctx, name, out)
+	if errno != fs.OK {
+		return nil, nil, 0, errno
+	}
+
+	return newInode, newNode.newFileHandle(), 0, fs.OK
+}
+
+// createFile creates an empty regular file on the device.
+func (mn *MCHNode) createFile(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, *MCHNode, syscall.Errno) {
+	now := time.Now()
+
+	newFile, err := mn.fsys.storage.Create(mn.getFile(), name, storage.Meta{MTime: now, CTime: now})
 	if err != nil {
-		return nil, nil, 0, syscall.EIO
+		return nil, nil, syscall.EIO
 	}
 
-	newNode := NewMCHNode(newFile)
+	newNode := mn.newChild(newFile)
 	newInode := mn.NewInode(ctx, newNode, fs.StableAttr{
 		Mode: newNode.mode(),
 	})
@@ -381,43 +951,90 @@ func (mn *MCHNode) Create(
 
 	var attr fuse.AttrOut
 
-	errno = newNode.Getattr(ctx, nil, &attr)
-	if errno != fs.OK {
-		return nil, nil, 0, errno
+	if errno := newNode.Getattr(ctx, nil, &attr); errno != fs.OK {
+		return nil, nil, errno
 	}
 
 	out.Attr = attr.Attr
 
-	return newInode, &MCHFileHandle{node: newNode}, 0, fs.OK
+	return newInode, newNode, fs.OK
 }
 
 func (mn *MCHNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if mn.fsys.options.ReadOnly {
+		return syscall.EROFS
+	}
+
 	if size, ok := in.GetSize(); ok {
-		if err := mn.file.Truncate(int64(size)); err != nil {
+		err := mn.modify(f, func(file *storage.FileInfo, opts ...storage.Option) error {
+			if size > file.Size {
+				// Extending a file is done writing zeros past its end
+				return mn.fsys.allocate(file, int64(size), opts...)
+			}
+
+			return mn.fsys.storage.Truncate(file, int64(size), opts...)
+		})
+		if err != nil {
+			return writeErrno(err)
+		}
+
+		mn.markWritten()
+	}
+
+	mode, modeOk := in.GetMode()
+	uid, uidOk := in.GetUID()
+	gid, gidOk := in.GetGID()
+
+	if modeOk || uidOk || gidOk {
+		if err := mn.setMetadata(optional(mode, modeOk), optional(uid, uidOk), optional(gid, gidOk)); err != nil {
 			return syscall.EIO
 		}
 	}
 
-	changes := make(map[string]interface{})
+	var changes storage.Meta
 
-	if mTime, ok := in.GetMTime(); ok {
-		changes["mTime"] = mch.ISOTime(mTime)
+	mTime, mTimeOk := in.GetMTime()
+	if mTimeOk {
+		changes.MTime = mTime
 	}
 
-	if cTime, ok := in.GetCTime(); ok {
-		changes["cTime"] = mch.ISOTime(cTime)
+	cTime, cTimeOk := in.GetCTime()
+	if cTimeOk {
+		changes.CTime = cTime
 	}
 
-	if len(changes) > 0 {
-		if err := mn.file.SetMeta(changes); err != nil {
-			return syscall.EIO
+	if mTimeOk || cTimeOk {
+		err := mn.modify(f, func(file *storage.FileInfo, opts ...storage.Option) error {
+			return mn.fsys.storage.SetMeta(file, changes, opts...)
+		})
+		if err != nil {
+			return writeErrno(err)
 		}
 	}
 
-	return mn.Getattr(ctx, f, out)
+	if mTimeOk {
+		mn.setExplicitMTime(mTime)
+	}
+
+	if aTime, ok := in.GetATime(); ok {
+		mn.setAccessTime(aTime)
+	}
+
+	return mn.refreshAttr(out)
+}
+
+// optional returns a pointer to value if it is set, otherwise nil.
+func optional(value uint32, ok bool) *uint32 {
+	if !ok {
+		return nil
+	}
+
+	return &value
 }
 
-func (*MCHNode) Mknod(
+// Mknod creates FIFOs and sockets, which exist only locally, as the device
+// has no way to store them, and regular files.
+func (mn *MCHNode) Mknod(
 	ctx context.Context,
 	name string,
 	mode uint32,
@@ -427,5 +1044,32 @@ func (*MCHNode) Mknod(
 	*fs.Inode,
 	syscall.Errno,
 ) {
-	return nil, syscall.ENOSYS
+	if mn.fsys.options.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	fileType := mode & syscall.S_IFMT
+	if fileType != syscall.S_IFIFO && fileType != syscall.S_IFSOCK && fileType != syscall.S_IFREG {
+		return nil, syscall.EPERM
+	}
+
+	name, err := mn.lookup(ctx, name)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	if mn.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	if fileType == syscall.S_IFREG && !mn.keepLocal(name) {
+		newInode, _, errno := mn.createFile(ctx, name, out)
+
+		return newInode, errno
+	}
+
+	newInode, newNode := mn.newLocalChild(ctx, name, mode)
+	newNode.getattr(&out.Attr)
+
+	return newInode, fs.OK
 }
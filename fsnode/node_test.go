@@ -0,0 +1,319 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+	"github.com/mnencia/mchfuse/storage"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	root := fsnode.NewMCHNode(nil, &storage.FileInfo{MimeType: storage.DirectoryMimeType}, fsnode.Options{ReadOnly: true})
+
+	var out fuse.EntryOut
+
+	checks := map[string]syscall.Errno{
+		"Unlink":  root.Unlink(ctx, "file"),
+		"Rmdir":   root.Rmdir(ctx, "dir"),
+		"Rename":  root.Rename(ctx, "file", root, "other", 0),
+		"Setattr": root.Setattr(ctx, nil, &fuse.SetAttrIn{}, &fuse.AttrOut{}),
+	}
+
+	_, checks["Mkdir"] = root.Mkdir(ctx, "dir", 0o755, &out)
+	_, _, _, checks["Create"] = root.Create(ctx, "file", 0, 0o644, &out)
+	_, checks["Symlink"] = root.Symlink(ctx, "target", "link", &out)
+	_, _, checks["Open"] = root.Open(ctx, syscall.O_RDWR)
+
+	for op, errno := range checks {
+		if errno != syscall.EROFS {
+			t.Errorf("%s returned %v instead of EROFS", op, errno)
+		}
+	}
+}
+
+// newRoot returns the root node of a filesystem, not mounted, showing the
+// files of the server, with the requests sent through the given faults.
+func newRoot(t *testing.T, server *mchtest.Server, options fsnode.Options, faults ...mchfault.Rule) *fsnode.MCHNode {
+	t.Helper()
+
+	transport := mchfault.New(1, faults...)
+	transport.Transport = server.Client().Transport
+
+	device, err := server.Device(mch.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootFile, err := device.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := fsnode.Unmounted(fsnode.NewMCHNode(device, rootFile.FileInfo(), options))
+	fs.NewNodeFS(root, &fs.Options{})
+
+	return root
+}
+
+func TestRenameOver(t *testing.T) {
+	unavailable := mchfault.Fault{Status: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		name     string
+		flags    uint32
+		faults   func(oldID, newID string) []mchfault.Rule
+		errno    syscall.Errno
+		expected map[string]string
+	}{
+		{
+			name:     "success",
+			faults:   func(oldID, newID string) []mchfault.Rule { return nil },
+			expected: map[string]string{"old": "new content"},
+		},
+		{
+			name:     "no replace",
+			flags:    1,
+			faults:   func(oldID, newID string) []mchfault.Rule { return nil },
+			errno:    syscall.EEXIST,
+			expected: map[string]string{"new": "new content", "old": "old content"},
+		},
+		{
+			name: "delete failure",
+			faults: func(oldID, newID string) []mchfault.Rule {
+				return []mchfault.Rule{{Method: http.MethodDelete, Path: "/sdk/v2/files/" + oldID, Fault: unavailable}}
+			},
+			errno:    syscall.EIO,
+			expected: map[string]string{"new": "new content", "old": "old content"},
+		},
+		{
+			// The replaced file is lost, but the renamed one is kept
+			name: "rename failure",
+			faults: func(oldID, newID string) []mchfault.Rule {
+				return []mchfault.Rule{
+					{Method: http.MethodPatch, Path: "/sdk/v2/files/" + newID, Times: 1},
+					{Method: http.MethodPatch, Path: "/sdk/v2/files/" + newID, Times: 1, Fault: unavailable},
+				}
+			},
+			errno:    syscall.EIO,
+			expected: map[string]string{"new": "new content"},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			server := mchtest.NewServer()
+			defer server.Close()
+
+			oldID := server.AddFile(mchtest.RootID, "old", []byte("old content"))
+			newID := server.AddFile(mchtest.RootID, "new", []byte("new content"))
+
+			root := newRoot(t, server, fsnode.Options{}, test.faults(oldID, newID)...)
+			ctx := context.Background()
+
+			for _, name := range []string{"old", "new"} {
+				if _, err := lookup(ctx, root, name); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if errno := root.Rename(ctx, "new", root, "old", test.flags); errno != test.errno {
+				t.Errorf("rename returned %v instead of %v", errno, test.errno)
+			}
+
+			names := server.Names(mchtest.RootID)
+			if len(names) != len(test.expected) {
+				t.Errorf("the device contains %q", names)
+			}
+
+			for name, content := range test.expected {
+				file, found := server.Stat(name)
+				if !found {
+					t.Errorf("%v is missing", name)
+
+					continue
+				}
+
+				if data, _ := server.Content(file.ID); string(data) != content {
+					t.Errorf("%v contains %q instead of %q", name, data, content)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupUnlinked(t *testing.T) {
+	old := time.Now().Add(-30 * 24 * time.Hour).Unix()
+	recent := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name     string
+		readOnly bool
+		deleted  bool
+	}{
+		{name: fmt.Sprintf(".mchfuse-deleted-other-%d-42", old), deleted: true},
+		{name: fmt.Sprintf(".mchfuse-deleted-other-%d-42", old), readOnly: true},
+		{name: fmt.Sprintf(".mchfuse-deleted-other-%d-42", recent)},
+		{name: ".mchfuse-deleted-other-42"},
+	}
+
+	for _, test := range tests {
+		server := mchtest.NewServer()
+		id := server.AddFile(mchtest.RootID, test.name, []byte("content"))
+
+		root := newRoot(t, server, fsnode.Options{ReadOnly: test.readOnly})
+
+		names, err := listNames(context.Background(), root)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(names) != 0 {
+			t.Errorf("listed %q", names)
+		}
+
+		if _, found := server.Content(id); found == test.deleted {
+			t.Errorf("%v in read-only %v: deleted %v instead of %v", test.name, test.readOnly, !found, test.deleted)
+		}
+
+		server.Close()
+	}
+}
+
+func TestRmdir(t *testing.T) {
+	tests := []struct {
+		name    string
+		content bool
+		faults  []mchfault.Rule
+		errno   syscall.Errno
+	}{
+		{name: "empty"},
+		{name: "not empty", content: true, errno: syscall.ENOTEMPTY},
+		{
+			name:   "listing failure",
+			faults: []mchfault.Rule{{Path: "/sdk/v2/filesSearch/parents", Fault: mchfault.Fault{Error: true}}},
+			errno:  syscall.EIO,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			server := mchtest.NewServer()
+			defer server.Close()
+
+			dirID := server.AddDirectory(mchtest.RootID, "dir")
+			if test.content {
+				server.AddFile(dirID, "file", []byte("content"))
+			}
+
+			root := newRoot(t, server, fsnode.Options{}, test.faults...)
+			ctx := context.Background()
+
+			if _, err := lookup(ctx, root, "dir"); err != nil {
+				t.Fatal(err)
+			}
+
+			if errno := root.Rmdir(ctx, "dir"); errno != test.errno {
+				t.Errorf("rmdir returned %v instead of %v", errno, test.errno)
+			}
+
+			// Only empty directories are deleted, never with their content
+			if _, found := server.Stat("dir"); found != (test.errno != fs.OK) {
+				t.Errorf("dir deleted: %v", !found)
+			}
+		})
+	}
+}
+
+func TestUnlinkOpen(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	root := newRoot(t, server, fsnode.Options{})
+	ctx := context.Background()
+
+	node, err := lookup(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var handles []fs.FileHandle
+
+	for i := 0; i < 2; i++ {
+		fh, _, errno := node.Open(ctx, syscall.O_RDONLY)
+		if errno != fs.OK {
+			t.Fatal(errno)
+		}
+
+		handles = append(handles, fh)
+	}
+
+	if errno := root.Unlink(ctx, "file"); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	// The file is still on the device, with a hidden name
+	if names := server.Names(mchtest.RootID); len(names) != 1 || !strings.HasPrefix(names[0], ".mchfuse-deleted-") {
+		t.Errorf("the device contains %q", names)
+	}
+
+	if names, err := listNames(ctx, root); err != nil || len(names) != 0 {
+		t.Errorf("listed %q (%v)", names, err)
+	}
+
+	for i, fh := range handles {
+		result, errno := fh.(fs.FileReader).Read(ctx, make([]byte, 16), 0)
+		if errno != fs.OK {
+			t.Fatalf("read from handle %d returned %v", i, errno)
+		}
+
+		if content, _ := result.Bytes(nil); string(content) != "content" {
+			t.Errorf("read %q from handle %d", content, i)
+		}
+	}
+
+	// The file is deleted when the last handle is released
+	for i, fh := range handles {
+		if errno := fh.(fs.FileReleaser).Release(ctx); errno != fs.OK {
+			t.Fatal(errno)
+		}
+
+		if _, found := server.Content(id); found != (i < len(handles)-1) {
+			t.Errorf("file on the device after releasing %d handles: %v", i+1, found)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"errors"
+	"io"
+	"log"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// copyBufferSize is the size of the chunks in which the content of the
+// files is copied.
+const copyBufferSize = 4 << 20
+
+// refresh replaces the information about the file with the current one.
+func (fsys *mchFS) refresh(file *storage.FileInfo) error {
+	info, err := fsys.storage.Stat(file.ID)
+	if err != nil {
+		return err
+	}
+
+	*file = *info
+
+	return nil
+}
+
+// lookupByID returns the child of the directory with the given ID, or nil
+// if the directory has no such child.
+func (fsys *mchFS) lookupByID(dir *storage.FileInfo, id string) (*storage.FileInfo, error) {
+	info, err := fsys.storage.Stat(id)
+	if errors.Is(err, storage.ErrorFileNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.ParentID != dir.ID {
+		return nil, nil
+	}
+
+	return info, nil
+}
+
+// allocate makes sure the file is at least size bytes long, extending it
+// with zeros if needed.
+func (fsys *mchFS) allocate(file *storage.FileInfo, size int64, opts ...storage.Option) error {
+	if size <= int64(file.Size) {
+		return nil
+	}
+
+	return fsys.storage.Write(file, nil, size, opts...)
+}
+
+// isEmpty reports whether the directory has no children. The information
+// about the directory is refreshed, and its content is listed, to avoid
+// deciding on stale information.
+func (fsys *mchFS) isEmpty(dir *storage.FileInfo) (bool, error) {
+	if err := fsys.refresh(dir); err != nil {
+		return false, err
+	}
+
+	if dir.ChildCount > 0 {
+		return false, nil
+	}
+
+	files, pageToken, err := fsys.storage.List(dir, "")
+	if err != nil {
+		return false, err
+	}
+
+	return len(files) == 0 && pageToken == "", nil
+}
+
+// discard deletes a file left incomplete by a failed operation, so that it
+// doesn't appear on the device.
+func (fsys *mchFS) discard(file *storage.FileInfo, name string) {
+	if err := fsys.storage.Delete(file); err != nil {
+		log.Printf("Error removing the incomplete file %v: %v", name, err)
+	}
+}
+
+// copyContent copies the content of the src file to the dest one, which
+// must be empty.
+func (fsys *mchFS) copyContent(src *storage.FileInfo, dest *storage.FileInfo) error {
+	// The information about the source is updated while reading it
+	file := *src
+	buf := make([]byte, copyBufferSize)
+
+	for offset := int64(0); ; {
+		n, err := fsys.storage.Read(&file, buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		if n == 0 {
+			return nil
+		}
+
+		if err := fsys.storage.Write(dest, buf[:n], offset); err != nil {
+			return err
+		}
+
+		offset += int64(n)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// symlinkMimeType is the MIME type of the regular files storing emulated
+// symbolic links. The content of the file is the target of the link.
+const symlinkMimeType = "application/x.mchfuse.symlink"
+
+// maxSymlinkSize is the maximum length of the target of a symbolic link.
+const maxSymlinkSize = 4096
+
+func (mn *MCHNode) isSymlink() bool {
+	return mn.fsys.isSymlink(mn.getFile())
+}
+
+func (fsys *mchFS) isSymlink(file *storage.FileInfo) bool {
+	return fsys.options.Symlinks && file.MimeType == symlinkMimeType
+}
+
+func (mn *MCHNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if !mn.isSymlink() {
+		return nil, syscall.EINVAL
+	}
+
+	// Reading updates the file information, so a copy is used
+	file := *mn.getFile()
+	if file.Size > maxSymlinkSize {
+		return nil, syscall.EIO
+	}
+
+	target := make([]byte, file.Size)
+
+	read, err := mn.fsys.storage.Read(&file, target, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, syscall.EIO
+	}
+
+	return target[:read], fs.OK
+}
+
+func (mn *MCHNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if mn.fsys.options.ReadOnly {
+		return nil, syscall.EROFS
+	}
+
+	if !mn.fsys.options.Symlinks {
+		return nil, syscall.EPERM
+	}
+
+	if len(target) > maxSymlinkSize {
+		return nil, syscall.ENAMETOOLONG
+	}
+
+	name, err := mn.lookup(ctx, name)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	if mn.GetChild(name) != nil {
+		return nil, syscall.EEXIST
+	}
+
+	if mn.excluded(name, false) {
+		return nil, syscall.EPERM
+	}
+
+	store := mn.fsys.storage
+
+	newFile, err := store.Create(mn.getFile(), name, storage.Meta{MimeType: symlinkMimeType})
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	// Make sure the MIME type has been stored, as it is the only thing
+	// distinguishing a link from a regular file
+	if newFile.MimeType != symlinkMimeType {
+		if err := store.SetMeta(newFile, storage.Meta{MimeType: symlinkMimeType}); err != nil {
+			mn.fsys.discard(newFile, name)
+
+			return nil, syscall.EIO
+		}
+
+		newFile.MimeType = symlinkMimeType
+	}
+
+	// A link without its target would be a broken link
+	if err := store.Write(newFile, []byte(target), 0); err != nil {
+		mn.fsys.discard(newFile, name)
+
+		return nil, syscall.EIO
+	}
+
+	newNode := mn.newChild(newFile)
+	newInode := mn.NewInode(ctx, newNode, fs.StableAttr{
+		Mode: newNode.mode(),
+	})
+	mn.AddChild(name, newInode, true)
+
+	newNode.getattr(&out.Attr)
+
+	return newInode, fs.OK
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+func TestSymlink(t *testing.T) {
+	targets := []string{"file", "../dir/file", "/absolute/path", "name with spaces", strings.Repeat("x/", 1000)}
+
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	root := newRoot(t, server, fsnode.Options{Symlinks: true})
+	ctx := context.Background()
+
+	for i, target := range targets {
+		name := "link" + string(rune('0'+i))
+
+		inode, errno := root.Symlink(ctx, target, name, &fuse.EntryOut{})
+		if errno != fs.OK {
+			t.Fatalf("symlink to %q: %v", target, errno)
+		}
+
+		if inode.Mode()&syscall.S_IFMT != syscall.S_IFLNK {
+			t.Errorf("%v has mode %o", name, inode.Mode())
+		}
+
+		if link, errno := inode.Operations().(fs.NodeReadlinker).Readlink(ctx); errno != fs.OK || string(link) != target {
+			t.Errorf("readlink %v returned %q, %v instead of %q", name, link, errno, target)
+		}
+	}
+
+	// The links are read back from the device by another mount
+	other := newRoot(t, server, fsnode.Options{Symlinks: true})
+
+	for i, target := range targets {
+		name := "link" + string(rune('0'+i))
+
+		link, err := lookup(ctx, other, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if data, errno := link.Readlink(ctx); errno != fs.OK || string(data) != target {
+			t.Errorf("readlink %v returned %q, %v instead of %q", name, data, errno, target)
+		}
+	}
+}
+
+func TestSymlinkFailure(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	root := newRoot(t, server, fsnode.Options{Symlinks: true}, mchfault.Rule{
+		Path:  "/sdk/v2/files/*/resumable",
+		Fault: mchfault.Fault{Status: http.StatusServiceUnavailable},
+	})
+
+	if _, errno := root.Symlink(context.Background(), "target", "link", &fuse.EntryOut{}); errno != syscall.EIO {
+		t.Errorf("symlink returned %v", errno)
+	}
+
+	// No link without its target is left on the device
+	if names := server.Names(mchtest.RootID); len(names) != 0 {
+		t.Errorf("the device contains %q", names)
+	}
+}
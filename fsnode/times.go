@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// accessTime returns the last access time of the file. The device doesn't
+// store it, so it is tracked in memory and it is never older than the
+// modification time.
+func (mn *MCHNode) accessTime() time.Time {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mtime := mn.getFile().MTime
+	if mn.atime.Before(mtime) {
+		return mtime
+	}
+
+	return mn.atime
+}
+
+func (mn *MCHNode) setAccessTime(atime time.Time) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.atime = atime
+}
+
+// setExplicitMTime records a modification time set while the file is open,
+// as tools like `cp -p` could write again to the file before closing it.
+func (mn *MCHNode) setExplicitMTime(mtime time.Time) {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if mn.openHandles == 0 {
+		return
+	}
+
+	mn.explicitMTime = &mtime
+	mn.written = false
+}
+
+// markWritten records that the content of the file has changed, which
+// makes the device update its modification time.
+func (mn *MCHNode) markWritten() {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.written = mn.explicitMTime != nil
+}
+
+// restoreExplicitMTime sets again, through the given handle, the
+// modification time explicitly set while the file was open, if it has been
+// written afterwards. The lock is not held while the device is contacted,
+// and the writes received in the meantime make the next flush restore the
+// modification time again.
+func (mn *MCHNode) restoreExplicitMTime(f fs.FileHandle) error {
+	mn.mu.Lock()
+
+	if mn.explicitMTime == nil || !mn.written {
+		mn.mu.Unlock()
+
+		return nil
+	}
+
+	explicitMTime := mn.explicitMTime
+	mtime := *explicitMTime
+	mn.written = false
+
+	mn.mu.Unlock()
+
+	err := mn.modify(f, func(file *storage.FileInfo, opts ...storage.Option) error {
+		return mn.fsys.storage.SetMeta(file, storage.Meta{MTime: mtime}, opts...)
+	})
+	if err != nil {
+		mn.mu.Lock()
+		mn.written = mn.written || mn.explicitMTime == explicitMTime
+		mn.mu.Unlock()
+
+		return err
+	}
+
+	return mn.updateFile(func(file *storage.FileInfo) error {
+		file.MTime = mtime
+
+		return nil
+	})
+}
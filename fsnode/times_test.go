@@ -0,0 +1,173 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+// setTimes sets the access and modification times which are not zero.
+func setTimes(ctx context.Context, file *fsnode.MCHNode, fh fs.FileHandle, atime, mtime time.Time) syscall.Errno {
+	var in fuse.SetAttrIn
+
+	if !atime.IsZero() {
+		in.Valid |= fuse.FATTR_ATIME
+		in.Atime, in.Atimensec = uint64(atime.Unix()), uint32(atime.Nanosecond())
+	}
+
+	if !mtime.IsZero() {
+		in.Valid |= fuse.FATTR_MTIME
+		in.Mtime, in.Mtimensec = uint64(mtime.Unix()), uint32(mtime.Nanosecond())
+	}
+
+	return file.Setattr(ctx, fh, &in, &fuse.AttrOut{})
+}
+
+func getTimes(ctx context.Context, t *testing.T, file *fsnode.MCHNode) (atime, mtime time.Time) {
+	t.Helper()
+
+	var out fuse.AttrOut
+	if errno := file.Getattr(ctx, nil, &out); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	return time.Unix(int64(out.Atime), int64(out.Atimensec)), time.Unix(int64(out.Mtime), int64(out.Mtimensec))
+}
+
+func TestExplicitMTime(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	root := newRoot(t, server, fsnode.Options{})
+	ctx := context.Background()
+
+	file, err := lookup(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, _, errno := file.Open(ctx, syscall.O_RDWR)
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	// Like `cp -p`, the modification time is set before the last writes
+	mtime := time.Date(2020, 4, 30, 12, 0, 0, 0, time.UTC)
+	if errno := setTimes(ctx, file, fh, time.Time{}, mtime); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, errno := fh.(fs.FileWriter).Write(ctx, []byte("CONTENT"), 0); errno != fs.OK {
+			t.Fatal(errno)
+		}
+
+		if errno := fh.(fs.FileFlusher).Flush(ctx); errno != fs.OK {
+			t.Fatal(errno)
+		}
+
+		if stat, _ := server.Stat("file"); !time.Time(stat.MTime).Equal(mtime) {
+			t.Errorf("the device has the modification time %v after write %d", time.Time(stat.MTime), i)
+		}
+
+		if _, got := getTimes(ctx, t, file); !got.Equal(mtime) {
+			t.Errorf("the modification time is %v after write %d", got, i)
+		}
+	}
+
+	if errno := fh.(fs.FileReleaser).Release(ctx); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	// Once the file is closed, writes update the modification time again
+	fh, _, errno = file.Open(ctx, syscall.O_RDWR)
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	defer fh.(fs.FileReleaser).Release(ctx)
+
+	if _, errno := fh.(fs.FileWriter).Write(ctx, []byte("content"), 0); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if errno := fh.(fs.FileFlusher).Flush(ctx); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if stat, _ := server.Stat("file"); time.Time(stat.MTime).Equal(mtime) {
+		t.Error("the modification time has been restored after closing the file")
+	}
+}
+
+func TestAccessTime(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	root := newRoot(t, server, fsnode.Options{})
+	ctx := context.Background()
+
+	file, err := lookup(ctx, root, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The access time is never older than the modification time
+	if atime, mtime := getTimes(ctx, t, file); !atime.Equal(mtime) {
+		t.Errorf("the access time is %v with the modification time %v", atime, mtime)
+	}
+
+	atime := time.Now().Add(time.Hour).Truncate(time.Second)
+	if errno := setTimes(ctx, file, nil, atime, time.Time{}); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if got, _ := getTimes(ctx, t, file); !got.Equal(atime) {
+		t.Errorf("the access time is %v instead of %v", got, atime)
+	}
+
+	// Reading the file updates the access time
+	fh, _, errno := file.Open(ctx, syscall.O_RDONLY)
+	if errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	defer fh.(fs.FileReleaser).Release(ctx)
+
+	before := time.Now()
+
+	if _, errno := fh.(fs.FileReader).Read(ctx, make([]byte, 16), 0); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if got, _ := getTimes(ctx, t, file); got.Before(before) || got.Equal(atime) {
+		t.Errorf("the access time is %v after reading at %v", got, before)
+	}
+}
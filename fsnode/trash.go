@@ -0,0 +1,50 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"path"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// Trash is where the deleted files are moved to.
+type Trash interface {
+	// Contains reports whether the directory with the given ID is inside
+	// the trash folder, including the directories moved to the trash.
+	Contains(dirID string) bool
+
+	// Put moves the file to the trash, recording that it was located at
+	// originPath.
+	Put(file *storage.FileInfo, originPath string) error
+}
+
+// trashEnabled reports whether the entries deleted from the directory
+// must be moved to the trash. This never happens for the directories of
+// the trash itself, where deletions are permanent.
+func (mn *MCHNode) trashEnabled() bool {
+	trash := mn.fsys.options.Trash
+
+	return trash != nil && !trash.Contains(mn.getFile().ID)
+}
+
+// moveToTrash moves the child with the given name to the trash.
+func (mn *MCHNode) moveToTrash(child *MCHNode, name string) error {
+	originPath := path.Join("/", mn.fsys.options.RootPath, mn.Path(nil), name)
+
+	return mn.fsys.options.Trash.Put(child.getFile(), originPath)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/mnencia/mchfuse/fsnode"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+	"github.com/mnencia/mchfuse/trash"
+)
+
+func TestTrash(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	dirID := server.AddDirectory(mchtest.RootID, "dir")
+	fileID := server.AddFile(dirID, "file", []byte("file"))
+	otherID := server.AddFile(dirID, "other", []byte("other"))
+
+	device, err := server.Device()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashFolder, err := trash.Open(device, "/.trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := newRoot(t, server, fsnode.Options{Trash: trashFolder, RootPath: "/"})
+	ctx := context.Background()
+
+	dir, err := lookup(ctx, root, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errno := dir.Unlink(ctx, "file"); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if _, found := server.Content(fileID); !found {
+		t.Error("the file has not been moved to the trash")
+	}
+
+	// The files deleted from a directory moved to the trash are removed
+	dirFile, err := device.GetFileByID(dirID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := trashFolder.Put(dirFile.FileInfo(), "/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := trashFolder.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashed := root
+
+	for _, name := range []string{".trash", "files", entries[len(entries)-1].Name} {
+		if trashed, err = lookup(ctx, trashed, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if errno := trashed.Unlink(ctx, "other"); errno != fs.OK {
+		t.Fatal(errno)
+	}
+
+	if _, found := server.Content(otherID); found {
+		t.Error("the file deleted from the trash has been kept")
+	}
+
+	if entries, _ := trashFolder.List(); len(entries) != 2 {
+		t.Errorf("the trash contains %+v", entries)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsnode
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// unlinkedPrefix is the prefix of the hidden name given to the files which
+// are unlinked while still open. The complete name is
+// `.mchfuse-deleted-<sessionID>-<unlink time>-<fileID>`, with the time in
+// seconds since the epoch.
+const unlinkedPrefix = ".mchfuse-deleted-"
+
+// unlinkedCleanupAge is how long after being unlinked the files of other
+// mounts are considered left behind, as the mounts could still be running
+// and using them.
+const unlinkedCleanupAge = 7 * 24 * time.Hour
+
+// newSessionID returns a random identifier for the current mount.
+func newSessionID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		log.Panicf("Error generating the session id: %v", err)
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+func isUnlinkedName(name string) bool {
+	return strings.HasPrefix(name, unlinkedPrefix)
+}
+
+// unlinkedName returns the hidden name of the node once unlinked.
+func (mn *MCHNode) unlinkedName() string {
+	return fmt.Sprintf("%s%s-%d-%s", unlinkedPrefix, mn.fsys.sessionID, time.Now().Unix(), mn.getFile().ID)
+}
+
+// unlink removes the file from the device. If the file is still open,
+// like NFS does, it is renamed to a hidden name inside the parent directory
+// and deleted when the last handle is released.
+func (mn *MCHNode) unlink(parent *storage.FileInfo) error {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	if mn.openHandles == 0 {
+		return mn.delete()
+	}
+
+	if err := mn.fsys.storage.Rename(mn.getFile(), parent, mn.unlinkedName()); err != nil {
+		return err
+	}
+
+	mn.unlinked = true
+
+	return nil
+}
+
+// releaseFileHandle keeps track of a released handle, deleting the file
+// from the device if it was the last handle of an unlinked file.
+func (mn *MCHNode) releaseFileHandle() error {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+
+	mn.openHandles--
+
+	if mn.openHandles == 0 {
+		mn.explicitMTime = nil
+		mn.written = false
+	}
+
+	if mn.openHandles > 0 || !mn.unlinked {
+		return nil
+	}
+
+	mn.unlinked = false
+
+	return mn.delete()
+}
+
+// delete removes the file and its local metadata.
+func (mn *MCHNode) delete() error {
+	if err := mn.fsys.storage.Delete(mn.getFile()); err != nil {
+		return err
+	}
+
+	return mn.deleteMetadata()
+}
+
+// cleanupUnlinked deletes a file which has been left behind by another
+// mount that has been unable to delete it when its last handle was
+// released. Only the files unlinked long ago are deleted, as the other
+// mount could still be running.
+func (mn *MCHNode) cleanupUnlinked(name string, info *storage.FileInfo) {
+	if mn.fsys.options.ReadOnly || strings.HasPrefix(name, unlinkedPrefix+mn.fsys.sessionID+"-") {
+		return
+	}
+
+	if time.Since(unlinkedTime(name, info)) < unlinkedCleanupAge {
+		return
+	}
+
+	if err := mn.fsys.storage.Delete(info); err != nil {
+		log.Printf("Error removing leftover unlinked file %v: %v", name, err)
+	}
+}
+
+// unlinkedTime returns when the file with the given unlinked name has been
+// unlinked. The names given by older versions don't contain the time, so
+// the modification time of the file is used for them.
+func unlinkedTime(name string, info *storage.FileInfo) time.Time {
+	parts := strings.SplitN(strings.TrimPrefix(name, unlinkedPrefix), "-", 3)
+	if len(parts) == 3 {
+		if seconds, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			return time.Unix(seconds, 0)
+		}
+	}
+
+	return info.MTime
+}
@@ -9,4 +9,5 @@ require (
 	github.com/hanwen/go-fuse/v2 v2.1.0
 	github.com/relvacode/iso8601 v1.1.0
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/text v0.3.7
 )
@@ -17,12 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"log/syslog"
 	"math"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -36,10 +39,25 @@ import (
 
 	"github.com/mnencia/mchfuse/fsnode"
 	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchrecord"
+	"github.com/mnencia/mchfuse/storage"
+	"github.com/mnencia/mchfuse/storage/localdir"
+	"github.com/mnencia/mchfuse/trash"
 )
 
 const (
 	defaultConfigFilePath = "/etc/mchfuse.conf"
+
+	// attrTimeout is how long the kernel and the filesystem cache the
+	// attributes of the files.
+	attrTimeout = time.Second
+
+	// retryAttempts and retryDelay control how the idempotent requests
+	// failed because of network errors or an unavailable service are sent
+	// again.
+	retryAttempts = 3
+	retryDelay    = time.Second
 )
 
 const (
@@ -60,22 +78,78 @@ func Version() string {
 }
 
 type config struct {
-	ConfigFilePath string `toml:"-"`
-	Username       string `toml:"username"`
-	Password       string `toml:"password"`
-	Debug          bool   `toml:"debug"`
-	Foreground     bool   `toml:"foreground"`
-	AllowOther     bool   `toml:"allow-other"`
-	UID            int64  `toml:"uid"`
-	GID            int64  `toml:"gid"`
+	ConfigFilePath string   `toml:"-"`
+	Username       string   `toml:"username"`
+	Password       string   `toml:"password"`
+	Debug          bool     `toml:"debug"`
+	Foreground     bool     `toml:"foreground"`
+	AllowOther     bool     `toml:"allow-other"`
+	UID            int64    `toml:"uid"`
+	GID            int64    `toml:"gid"`
+	ReadOnly       bool     `toml:"read-only"`
+	Symlinks       bool     `toml:"symlinks"`
+	MetadataDB     string   `toml:"metadata-db"`
+	DirMode        fileMode `toml:"dir-mode"`
+	FileMode       fileMode `toml:"file-mode"`
+	Umask          fileMode `toml:"umask"`
+	Trash          string   `toml:"trash"`
+	LocalPatterns  []string `toml:"local-patterns"`
+	LocalMaxSize   int64    `toml:"local-max-size"`
+	Hidden         string   `toml:"hidden"`
+	Normalization  string   `toml:"normalization"`
+	Conflict       string   `toml:"conflict"`
+	CacheSize      int      `toml:"cache-size"`
+	Filter         []string `toml:"filter"`
+	FilterFrom     string   `toml:"filter-from"`
+	LocalDir       string   `toml:"local-dir"`
+	RecordHTTP     string   `toml:"record-http"`
+	InjectFaults   string   `toml:"inject-faults"`
+
+	// The filter, the metadata database and the trash folder are opened
+	// before going in the background, so their errors are reported
+	filter      *fsnode.Filter
+	metadata    *fsnode.MetadataStore
+	trashFolder *trash.Trash
+}
+
+var errInvalidFileMode = errors.New("invalid file mode")
+
+// fileMode is a set of permission bits expressed in octal notation.
+type fileMode uint32
+
+func (m *fileMode) Set(value string) error {
+	intVal, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || intVal > 0o7777 {
+		return fmt.Errorf("%q: %w", value, errInvalidFileMode)
+	}
+
+	*m = fileMode(intVal)
+
+	return nil
+}
+
+func (m fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+func (m *fileMode) Type() string {
+	return "mode"
+}
+
+func (m *fileMode) UnmarshalText(text []byte) error {
+	return m.Set(string(text))
 }
 
 func (c *config) loadMountOptions(options string) {
 	optionsMap := parseOptions(options)
 	for key, val := range optionsMap {
 		switch key {
-		case "rw", "ro", "dev", "nodev", "suid", "nosuid":
+		case "dev", "nodev", "suid", "nosuid":
 			// ignoring these options
+		case "ro", "read-only", "read_only":
+			c.ReadOnly = true
+		case "rw":
+			c.ReadOnly = false
 		case "config":
 			c.ConfigFilePath = val
 		case "username":
@@ -88,6 +162,42 @@ func (c *config) loadMountOptions(options string) {
 			c.Foreground = true
 		case "allow-other", "allow_other":
 			c.AllowOther = true
+		case "symlinks":
+			c.Symlinks = true
+		case "metadata-db", "metadata_db":
+			c.MetadataDB = val
+		case "dir-mode", "dir_mode":
+			c.setModeOption(&c.DirMode, key, val)
+		case "file-mode", "file_mode":
+			c.setModeOption(&c.FileMode, key, val)
+		case "umask":
+			c.setModeOption(&c.Umask, key, val)
+		case "trash":
+			c.Trash = val
+		case "hidden":
+			c.Hidden = val
+		case "normalization":
+			c.Normalization = val
+		case "conflict":
+			c.Conflict = val
+		case "cache-size", "cache_size":
+			if intVal, err := strconv.Atoi(val); err == nil && intVal > 0 {
+				c.CacheSize = intVal
+			} else {
+				log.Fatalf("Invalid cache-size mount option: '%v'\n", val)
+			}
+		case "filter-from", "filter_from":
+			c.FilterFrom = val
+		case "local-dir", "local_dir":
+			c.LocalDir = val
+		case "local-patterns", "local_patterns":
+			c.LocalPatterns = append(c.LocalPatterns, strings.Split(val, ":")...)
+		case "local-max-size", "local_max_size":
+			if intVal, err := strconv.ParseInt(val, 10, 64); err == nil && intVal > 0 {
+				c.LocalMaxSize = intVal
+			} else {
+				log.Fatalf("Invalid local-max-size mount option: '%v'\n", val)
+			}
 		case "uid":
 			if intVal, err := strconv.ParseInt(val, 10, 64); err == nil {
 				if intVal > math.MaxUint32 {
@@ -114,6 +224,12 @@ func (c *config) loadMountOptions(options string) {
 	}
 }
 
+func (c *config) setModeOption(mode *fileMode, key, val string) {
+	if err := mode.Set(val); err != nil {
+		log.Fatalf("Failed to parse %v mount option: '%v'\n", key, err)
+	}
+}
+
 func parseOptions(options string) map[string]string {
 	optionsMap := make(map[string]string)
 
@@ -153,8 +269,12 @@ func parseOption(s string, optionsMap map[string]string) {
 
 func parseConfig() config {
 	c := config{
-		UID: -1,
-		GID: -1,
+		UID:          -1,
+		GID:          -1,
+		DirMode:      fsnode.DefaultDirMode,
+		FileMode:     fsnode.DefaultFileMode,
+		CacheSize:    fsnode.DefaultCacheSize,
+		LocalMaxSize: fsnode.DefaultLocalMaxSize,
 	}
 
 	var options string
@@ -167,6 +287,34 @@ func parseConfig() config {
 	flag.BoolVarP(&c.AllowOther, "allow-other", "a", c.AllowOther, "allow other users")
 	flag.Int64VarP(&c.UID, "uid", "U", c.UID, "set the owner of the files in the filesystem")
 	flag.Int64VarP(&c.GID, "gid", "G", c.GID, "set the group of the files in the filesystem")
+	flag.BoolVarP(&c.ReadOnly, "read-only", "r", c.ReadOnly, "mount the filesystem read-only")
+	flag.BoolVarP(&c.Symlinks, "symlinks", "s", c.Symlinks, "emulate symbolic links")
+	flag.StringVarP(&c.MetadataDB, "metadata-db", "m", c.MetadataDB, "store permissions and ownership in this file")
+	flag.VarP(&c.DirMode, "dir-mode", "D", "permissions of the directories")
+	flag.VarP(&c.FileMode, "file-mode", "F", "permissions of the files")
+	flag.VarP(&c.Umask, "umask", "M", "permissions to remove from directories and files")
+	flag.StringVarP(&c.Trash, "trash", "t", c.Trash, "move deleted files to this folder of the device")
+	flag.StringArrayVarP(&c.LocalPatterns, "local-patterns", "l", c.LocalPatterns,
+		"keep the files matching this pattern only in memory (can be repeated)")
+	flag.Int64Var(&c.LocalMaxSize, "local-max-size", c.LocalMaxSize,
+		"maximum size in bytes of each file kept only in memory")
+	flag.StringVarP(&c.Hidden, "hidden", "H", c.Hidden,
+		"hide the files hidden on the device for this OS: "+strings.Join(mch.HiddenModes(), ", "))
+	flag.StringVarP(&c.Normalization, "normalization", "n", c.Normalization,
+		"Unicode normalization of the file names: "+strings.Join(fsnode.NormalizationForms(), ", "))
+	flag.StringVarP(&c.Conflict, "conflict", "C", c.Conflict,
+		"handling of files changed by other clients while open: "+strings.Join(fsnode.ConflictModes(), ", "))
+	flag.IntVarP(&c.CacheSize, "cache-size", "S", c.CacheSize,
+		"number of directory entries kept in the metadata cache")
+	flag.StringArrayVarP(&c.Filter, "filter", "X", c.Filter,
+		"add a filter rule to hide files, e.g. '- .DS_Store' (can be repeated)")
+	flag.StringVarP(&c.FilterFrom, "filter-from", "x", c.FilterFrom, "read the filter rules from this file")
+	flag.StringVarP(&c.LocalDir, "local-dir", "L", c.LocalDir,
+		"serve this local directory instead of a device, which is only used as filesystem name")
+	flag.StringVar(&c.RecordHTTP, "record-http", c.RecordHTTP,
+		"record the requests to the services, with the credentials redacted, to this fixture file")
+	flag.StringVar(&c.InjectFaults, "inject-faults", c.InjectFaults,
+		"inject the faults described by these rules in the requests to the services")
 	flag.BoolVarP(&c.Foreground, "foreground", "f", c.Foreground, "do not demonize")
 	flag.BoolVarP(&c.Debug, "debug", "d", c.Debug, "activate debug output (implies --foreground)")
 	flag.StringVarP(&options, "options", "o", "", "mount options")
@@ -176,6 +324,9 @@ func parseConfig() config {
 	// The `options` flag is only to support being called by mount.
 	// We hide it in the user help
 	flag.Lookup("options").Hidden = true
+	// The `record-http` and `inject-faults` flags are only to test MCHFuse
+	flag.Lookup("record-http").Hidden = true
+	flag.Lookup("inject-faults").Hidden = true
 	flag.Lookup("uid").DefValue = "disabled"
 	flag.Lookup("gid").DefValue = "disabled"
 
@@ -222,12 +373,18 @@ func (c *config) loadConfigFile() {
 }
 
 func (c *config) validateConfig() {
-	if c.Username == "" {
-		log.Fatalf("Username is required. Set it in configuration file or specify it with --username flag.\n")
-	}
+	if c.LocalDir != "" {
+		if c.Trash != "" {
+			log.Fatalf("The trash is not supported with a local directory.\n")
+		}
+	} else {
+		if c.Username == "" {
+			log.Fatalf("Username is required. Set it in configuration file or specify it with --username flag.\n")
+		}
 
-	if c.Password == "" {
-		log.Fatalf("Password is required. Set it in configuration file or specify it with --password flag.\n")
+		if c.Password == "" {
+			log.Fatalf("Password is required. Set it in configuration file or specify it with --password flag.\n")
+		}
 	}
 
 	if c.UID < 0 {
@@ -238,12 +395,110 @@ func (c *config) validateConfig() {
 		c.GID = int64(syscall.Getgid())
 	}
 
+	if c.Hidden != "" && !contains(mch.HiddenModes(), c.Hidden) {
+		log.Fatalf("Invalid hidden option '%v' (valid values: %v)\n", c.Hidden, strings.Join(mch.HiddenModes(), ", "))
+	}
+
+	c.Normalization = strings.ToLower(c.Normalization)
+	if c.Normalization != "" && !contains(fsnode.NormalizationForms(), c.Normalization) {
+		log.Fatalf("Invalid normalization option '%v' (valid values: %v)\n",
+			c.Normalization, strings.Join(fsnode.NormalizationForms(), ", "))
+	}
+
+	if c.Conflict != "" && !contains(fsnode.ConflictModes(), c.Conflict) {
+		log.Fatalf("Invalid conflict option '%v' (valid values: %v)\n",
+			c.Conflict, strings.Join(fsnode.ConflictModes(), ", "))
+	}
+
+	if c.CacheSize <= 0 {
+		log.Fatalf("Invalid cache size %v: it must be greater than zero\n", c.CacheSize)
+	}
+
+	if c.LocalMaxSize <= 0 {
+		log.Fatalf("Invalid local max size %v: it must be greater than zero\n", c.LocalMaxSize)
+	}
+
+	// Flags are parsed twice, so the patterns could be repeated
+	patterns := make([]string, 0, len(c.LocalPatterns))
+	seen := make(map[string]bool)
+
+	for _, pattern := range c.LocalPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("Invalid local pattern '%v': %v\n", pattern, err)
+		}
+
+		if !seen[pattern] {
+			seen[pattern] = true
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	c.LocalPatterns = patterns
+
+	if len(c.Filter) > 0 || c.FilterFrom != "" {
+		c.filter = c.loadFilter()
+	}
+
+	if c.MetadataDB != "" {
+		c.metadata = c.openMetadataStore()
+	}
+
 	// Debugging implies running in foreground
 	c.Foreground = c.Foreground || c.Debug
 }
 
+// loadFilter returns the filter made by the filter rules, followed by the
+// ones in the filter file.
+func (c *config) loadFilter() *fsnode.Filter {
+	rules := c.Filter
+
+	if c.FilterFrom != "" {
+		fileRules, err := fsnode.ReadFilterFile(c.FilterFrom)
+		if err != nil {
+			log.Fatalf("Failure reading filter file %v: %v\n", c.FilterFrom, err)
+		}
+
+		rules = append(rules, fileRules...)
+	}
+
+	filter, err := fsnode.NewFilter(rules)
+	if err != nil {
+		log.Fatalf("Invalid filter: %v\n", err)
+	}
+
+	return filter
+}
+
+// openMetadataStore opens the metadata database, which is saved in its
+// directory, so that must exist too.
+func (c *config) openMetadataStore() *fsnode.MetadataStore {
+	dir := filepath.Dir(c.MetadataDB)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Fatalf("Invalid metadata database %v: directory %v not found\n", c.MetadataDB, dir)
+	}
+
+	store, err := fsnode.OpenMetadataStore(c.MetadataDB)
+	if err != nil {
+		log.Fatalf("Failure opening metadata database %v: %v\n", c.MetadataDB, err)
+	}
+
+	return store
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *config) printUsage() {
 	_, _ = fmt.Fprintf(os.Stderr, "Usage: %v [flags] deviceName[:devicePath] mountpoint\n", path.Base(os.Args[0]))
+	_, _ = fmt.Fprintf(os.Stderr, "       %v [flags] trash deviceName list|restore NAME...|purge [AGE]\n",
+		path.Base(os.Args[0]))
 
 	flag.PrintDefaults()
 }
@@ -255,6 +510,11 @@ func (c *config) printVersion() {
 func main() {
 	config := parseConfig()
 
+	if flag.Arg(0) == trashCommand {
+		runTrashCommand(config, flag.Args()[1:])
+		return
+	}
+
 	if len(flag.Args()) <= mountPointPos {
 		config.printUsage()
 		os.Exit(1)
@@ -272,11 +532,71 @@ func main() {
 		deviceName = source
 	}
 
-	client, err := mch.Login(config.Username, config.Password)
+	var (
+		store storage.Storage
+		file  *storage.FileInfo
+	)
+
+	if config.LocalDir != "" {
+		store, file = openLocalDir(config.LocalDir, devicePath)
+	} else {
+		device := connect(config, deviceName)
+
+		deviceFile, err := device.GetFileByPath(devicePath)
+		if err != nil {
+			log.Fatalf("Failure searching for path %s: %s", devicePath, err)
+		}
+
+		store, file = device, deviceFile.FileInfo()
+
+		if config.Trash != "" {
+			trashFolder, err := trash.Open(device, config.Trash)
+			if err != nil {
+				log.Fatalf("Failure opening trash folder %s: %s", config.Trash, err)
+			}
+
+			config.trashFolder = trashFolder
+		}
+	}
+
+	if !config.Foreground {
+		if _, _, err := godaemon.MakeDaemon(&godaemon.DaemonAttr{}); err != nil {
+			log.Fatalf("Error demonising: %s", err)
+		}
+
+		// Logging output must go to syslog as stderr is not available in a daemon process
+		redirectOutputToSyslog()
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "Starting MCHFuse version %v", Version())
+
+	if err := mount(store, file, devicePath, source, mountPoint, config); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connect signs in the My Cloud Home account and returns the device with
+// the given name.
+func connect(config config, deviceName string) *mch.Device {
+	opts := []mch.LoginOption{
+		mch.WithHTTPClient(&http.Client{Transport: httpTransport(config)}),
+		mch.WithMiddleware(mch.Retry(retryAttempts, retryDelay)),
+	}
+
+	// Logging after the retries shows every attempt
+	if config.Debug {
+		opts = append(opts, mch.WithMiddleware(mch.Logging(log.Printf)))
+	}
+
+	client, err := mch.Login(config.Username, config.Password, opts...)
 	if err != nil {
 		log.Fatalf("Failure signing in My Cloud Home account: %s", err)
 	}
 
+	if config.Hidden != "" {
+		client.Hidden = config.Hidden
+	}
+
 	deviceList, err := client.DeviceInfo()
 	if err != nil {
 		log.Fatalf("Failure retrieving device list: %s", err)
@@ -285,32 +605,66 @@ func main() {
 	device := deviceList.Find(deviceName)
 	if device == nil {
 		available := make([]string, 0)
-		for _, device := range deviceList.Data {
-			available = append(available, device.Name)
+		for i := range deviceList.Data {
+			available = append(available, deviceList.Data[i].Name)
 		}
 
 		log.Fatalf("Unknown device \"%s\" (available devices: %s)", deviceName, strings.Join(available, ", "))
 	}
 
-	file, err := device.GetFileByPath(devicePath)
-	if err != nil {
-		log.Fatalf("Failure searching for path %s: %s", devicePath, err)
+	return device
+}
+
+// httpTransport returns the transport sending the requests to the services,
+// which injects the faults and records the requests if requested. The
+// injected faults are recorded too.
+func httpTransport(config config) http.RoundTripper {
+	transport := http.DefaultTransport
+
+	if config.InjectFaults != "" {
+		rules, err := mchfault.ParseRules(config.InjectFaults)
+		if err != nil {
+			log.Fatalf("Failure parsing fault rules: %s", err)
+		}
+
+		// A fixed seed injects the same faults in the same sequence of requests
+		faults := mchfault.New(1, rules...)
+		faults.Transport = transport
+		transport = faults
 	}
 
-	if !config.Foreground {
-		if _, _, err := godaemon.MakeDaemon(&godaemon.DaemonAttr{}); err != nil {
-			log.Fatalf("Error demonising: %s", err)
+	if config.RecordHTTP != "" {
+		recorder, err := mchrecord.Create(config.RecordHTTP)
+		if err != nil {
+			log.Fatalf("Failure creating HTTP recording %s: %s", config.RecordHTTP, err)
 		}
 
-		// Logging output must go to syslog as stderr is not available in a daemon process
-		redirectOutputToSyslog()
+		recorder.Transport = transport
+		transport = recorder
 	}
 
-	_, _ = fmt.Fprintf(os.Stderr, "Starting MCHFuse version %v", Version())
+	return transport
+}
 
-	if err := mount(file, source, mountPoint, config); err != nil {
-		log.Fatal(err)
+// openLocalDir returns the local directory served instead of a device, and
+// the directory with the given path inside it.
+func openLocalDir(dir string, dirPath string) (*localdir.Storage, *storage.FileInfo) {
+	store, err := localdir.Open(dir)
+	if err != nil {
+		log.Fatalf("Failure opening local directory %s: %s", dir, err)
+	}
+
+	root, err := store.Root()
+	if err != nil {
+		log.Fatalf("Failure opening local directory %s: %s", dir, err)
 	}
+
+	file, err := storage.LookupPath(store, root, dirPath)
+	if err != nil {
+		log.Fatalf("Failure searching for path %s: %s", dirPath, err)
+	}
+
+	return store, file
 }
 
 func redirectOutputToSyslog() {
@@ -325,9 +679,33 @@ func redirectOutputToSyslog() {
 	os.Stderr = os.NewFile(uintptr(syscall.Stderr), os.DevNull)
 }
 
-func mount(file *mch.File, source, mountPoint string, config config) error {
-	mchRoot := fsnode.NewMCHNode(file)
-	sec := time.Second
+func mount(store storage.Storage, file *storage.FileInfo, devicePath, source, mountPoint string, config config) error {
+	options := fsnode.Options{
+		ReadOnly:      config.ReadOnly,
+		Symlinks:      config.Symlinks,
+		LocalPatterns: config.LocalPatterns,
+		LocalMaxSize:  config.LocalMaxSize,
+		Normalization: config.Normalization,
+		Conflict:      config.Conflict,
+		CacheSize:     config.CacheSize,
+		AttrTimeout:   attrTimeout,
+		DirMode:       uint32(config.DirMode),
+		FileMode:      uint32(config.FileMode),
+		Umask:         uint32(config.Umask),
+		UID:           uint32(config.UID),
+		GID:           uint32(config.GID),
+		Filter:        config.filter,
+		Metadata:      config.metadata,
+	}
+
+	// The trash is an interface, which must stay nil if not used
+	if config.trashFolder != nil {
+		options.Trash = config.trashFolder
+		options.RootPath = devicePath
+	}
+
+	mchRoot := fsnode.NewMCHNode(store, file, options)
+	sec := attrTimeout
 	mountOpts := &fs.Options{
 		MountOptions: fuse.MountOptions{
 			AllowOther: config.AllowOther,
@@ -341,6 +719,10 @@ func mount(file *mch.File, source, mountPoint string, config config) error {
 		AttrTimeout:  &sec,
 		EntryTimeout: &sec,
 	}
+	if config.ReadOnly {
+		mountOpts.Options = append(mountOpts.Options, "ro")
+	}
+
 	// Mount the file system
 	server, err := fs.Mount(mountPoint, mchRoot, mountOpts)
 	if err != nil {
@@ -349,5 +731,9 @@ func mount(file *mch.File, source, mountPoint string, config config) error {
 	// Serve the file system, until unmounted by calling fusermount -u
 	server.Wait()
 
+	if config.metadata != nil {
+		return config.metadata.Flush()
+	}
+
 	return nil
 }
@@ -25,6 +25,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -41,6 +42,28 @@ type Client struct {
 	Configuration *Configuration `json:"configuration,omitempty"`
 	OSType        string         `json:"os_type,omitempty"`
 	HTTPClient    http.Client    `json:"-"`
+
+	// tokenMu protects the tokens, which are refreshed by concurrent requests
+	tokenMu sync.Mutex
+
+	// Hidden selects which files, hidden on the device following the
+	// conventions of an OS, are excluded from the searches. It defaults
+	// to the OSType.
+	Hidden string `json:"-"`
+}
+
+// Values accepted by Client.Hidden.
+const (
+	HiddenNone    = "none"
+	HiddenLinux   = "linux"
+	HiddenWindows = "windows"
+	HiddenMac     = "mac"
+	HiddenAll     = "all"
+)
+
+// HiddenModes lists the values accepted by Client.Hidden.
+func HiddenModes() []string {
+	return []string{HiddenNone, HiddenLinux, HiddenWindows, HiddenMac, HiddenAll}
 }
 
 const (
@@ -50,13 +73,46 @@ const (
 
 var ErrorUnexpectedStatusCode = errors.New("unexpected status code")
 
-func Login(username string, password string) (*Client, error) {
-	config, err := GetConfiguration()
+// LoginOption customizes the client created by Login.
+type LoginOption func(options *loginOptions)
+
+type loginOptions struct {
+	httpClient       http.Client
+	configurationURL string
+	middleware       []Middleware
+}
+
+// WithHTTPClient makes the client use a copy of the given HTTP client.
+func WithHTTPClient(httpClient *http.Client) LoginOption {
+	return func(options *loginOptions) {
+		options.httpClient = *httpClient
+	}
+}
+
+// WithConfigurationURL makes the client read the configuration of the
+// service, containing the URLs of the other endpoints, from the given URL.
+func WithConfigurationURL(url string) LoginOption {
+	return func(options *loginOptions) {
+		options.configurationURL = url
+	}
+}
+
+func Login(username string, password string, opts ...LoginOption) (*Client, error) {
+	options := loginOptions{configurationURL: configURL}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	client := &Client{OSType: osType(), HTTPClient: options.httpClient}
+	client.Hidden = client.OSType
+	client.HTTPClient.Transport = client.chain(options.httpClient.Transport, options.middleware)
+
+	config, err := getConfiguration(&client.HTTPClient, options.configurationURL)
 	if err != nil {
 		return nil, err
 	}
 
-	client := Client{Configuration: config, OSType: osType()}
+	client.Configuration = config
 
 	req := map[string]string{
 		"grant_type":    "http://auth0.com/oauth/grant-type/password-realm",
@@ -93,17 +149,19 @@ func Login(username string, password string) (*Client, error) {
 		return nil, err
 	}
 
-	return &client, nil
+	return client, nil
 }
 
 func osType() string {
 	switch runtime.GOOS {
-	case "linux", "windows":
-		return runtime.GOOS
+	case "linux":
+		return HiddenLinux
+	case "windows":
+		return HiddenWindows
 	case "darwin":
-		return "mac"
+		return HiddenMac
 	default:
-		return "none"
+		return HiddenNone
 	}
 }
 
@@ -175,25 +233,54 @@ func (c *Client) isAccessTokenExpired() bool {
 	return time.Now().Unix() > exp
 }
 
+// NewAuthorizedRequest returns a request with the access token of the
+// client, refreshed if expired, in the Authorization header. If sent with
+// the HTTP client of the client, the token is refreshed again when needed.
 func (c *Client) NewAuthorizedRequest(method, url string, body io.Reader) (*http.Request, error) {
-	if c.isAccessTokenExpired() {
-		if err := c.refreshAccessToken(); err != nil {
-			return nil, err
-		}
+	accessToken, err := c.accessToken()
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequest(method, url, body)
+	req, err := c.newAuthorizedRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", "Bearer "+c.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 
 	return req, nil
 }
 
+// newAuthorizedRequest returns a request which is sent with the access
+// token of the client, refreshed if expired. The token is added by the
+// package middleware, so the middleware added with WithMiddleware don't
+// see it.
+func (c *Client) newAuthorizedRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return withRequestInfo(req, requestInfo{authorized: true}), nil
+}
+
+// accessToken returns a valid access token, refreshing it if expired.
+func (c *Client) accessToken() (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if c.isAccessTokenExpired() {
+		if err := c.refreshAccessToken(); err != nil {
+			return "", err
+		}
+	}
+
+	return c.AccessToken, nil
+}
+
 func (c *Client) DeviceInfo() (*DeviceInfo, error) {
-	req, err := c.NewAuthorizedRequest(
+	req, err := c.newAuthorizedRequest(
 		"GET",
 		fmt.Sprintf(
 			"%s/device/v1/user/%s",
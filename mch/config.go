@@ -36,7 +36,11 @@ type Configuration struct {
 }
 
 func GetConfiguration() (*Configuration, error) {
-	resp, err := http.Get(configURL)
+	return getConfiguration(http.DefaultClient, configURL)
+}
+
+func getConfiguration(httpClient *http.Client, url string) (*Configuration, error) {
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
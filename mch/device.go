@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -47,8 +48,12 @@ type Device struct {
 	SerialNumber         string        `json:"serialNumber"`
 	APIVersion           string        `json:"apiVersion"`
 	client               *Client
-	connectionMode       DeviceConnectionMode
-	connectionCheckedAt  time.Time
+
+	// connectionMu protects the connection mode, which is checked again by
+	// concurrent requests
+	connectionMu        sync.Mutex
+	connectionMode      DeviceConnectionMode
+	connectionCheckedAt time.Time
 }
 
 type DeviceNetwork struct {
@@ -91,40 +96,64 @@ func (dm DeviceConnectionMode) String() string {
 	}
 }
 
-func (di DeviceInfo) Find(name string) *Device {
-	for _, device := range di.Data {
-		if device.Name == name || device.DeviceID == name {
-			return &device
+func (di *DeviceInfo) Find(name string) *Device {
+	for i := range di.Data {
+		if di.Data[i].Name == name || di.Data[i].DeviceID == name {
+			return &di.Data[i]
 		}
 	}
 
 	return nil
 }
 
+// checkConnectionMode checks whether the device is reachable on the local
+// network, returning true if the connection mode changed.
 func (d *Device) checkConnectionMode() bool {
-	oldMode := d.connectionMode
+	return d.setConnectionMode(d.probeConnectionMode())
+}
+
+// probeConnectionMode tries to connect to the device on the local network.
+// It is called without holding connectionMu, so the concurrent requests
+// don't wait for the connection to time out.
+func (d *Device) probeConnectionMode() DeviceConnectionMode {
 	address := d.Network.InternalDNSName
 	timeout := 1 * time.Second
 
 	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
-		d.connectionMode = ExternalConnection
-	} else {
-		_ = conn.Close()
-		d.connectionMode = InternalConnection
+		return ExternalConnection
 	}
 
+	_ = conn.Close()
+
+	return InternalConnection
+}
+
+// setConnectionMode stores the result of a probe, returning true if the
+// connection mode changed.
+func (d *Device) setConnectionMode(mode DeviceConnectionMode) bool {
+	d.connectionMu.Lock()
+	defer d.connectionMu.Unlock()
+
+	oldMode := d.connectionMode
+	d.connectionMode = mode
 	d.connectionCheckedAt = time.Now()
 
-	return oldMode != d.connectionMode
+	return oldMode != mode
 }
 
 func (d *Device) DeviceURI() string {
-	if d.connectionMode == UnknownConnection || time.Since(d.connectionCheckedAt) > ConnectionRecheckTime {
-		d.checkConnectionMode()
+	d.connectionMu.Lock()
+	mode := d.connectionMode
+	stale := mode == UnknownConnection || time.Since(d.connectionCheckedAt) > ConnectionRecheckTime
+	d.connectionMu.Unlock()
+
+	if stale {
+		mode = d.probeConnectionMode()
+		d.setConnectionMode(mode)
 	}
 
-	if d.connectionMode == ExternalConnection {
+	if mode == ExternalConnection {
 		return d.Network.ExternalURI
 	}
 
@@ -146,25 +175,18 @@ func (d *Device) api(
 ) {
 	uri := d.getURI(path)
 
-	req, err := d.client.NewAuthorizedRequest(method, uri, body)
+	req, err := d.client.newAuthorizedRequest(method, uri, body)
 	if err != nil {
 		return nil, err
 	}
 
+	req = withRequestInfo(req, requestInfo{authorized: true, device: d})
+
 	if requestMutator != nil {
 		requestMutator(req)
 	}
 
-	resp, err := d.client.HTTPClient.Do(req)
-	if err != nil {
-		if d.checkConnectionMode() {
-			return nil, fmt.Errorf("connection mode changed after an error: %w", err)
-		}
-
-		return nil, err
-	}
-
-	return resp, nil
+	return d.client.HTTPClient.Do(req)
 }
 
 func (d *Device) fileSearchParents(ids string, pageToken string) (*FileList, error) {
@@ -172,7 +194,7 @@ func (d *Device) fileSearchParents(ids string, pageToken string) (*FileList, err
 		q := req.URL.Query()
 		q.Add("ids", ids)
 		q.Add("fields", "pageToken,"+FileFields)
-		q.Add("hidden", d.client.OSType)
+		q.Add("hidden", d.client.Hidden)
 
 		if pageToken != "" {
 			q.Add("pageToken", pageToken)
@@ -229,6 +251,7 @@ func (d *Device) fileSearchParentAndName(parentID string, name string) (*File, e
 			q.Add("name", name)
 			q.Add("parentID", parentID)
 			q.Add("fields", FileFields)
+			q.Add("hidden", d.client.Hidden)
 			req.URL.RawQuery = q.Encode()
 		},
 	)
@@ -286,7 +309,11 @@ func (d *Device) fileByID(id string, file *File) (*File, error) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%v: %w", id, ErrorFileNotFound)
+	default:
 		return nil, fmt.Errorf(
 			"status code %v retrieveing file metadata %v at %v: %w",
 			resp.StatusCode,
@@ -316,6 +343,10 @@ func (d *Device) Root() (*File, error) {
 	return d.fileByID("root", &File{})
 }
 
+func (d *Device) GetFileByID(id string) (*File, error) {
+	return d.fileByID(id, &File{})
+}
+
 func (d *Device) GetFileByPath(path string) (*File, error) {
 	path = strings.Trim(path, "/")
 
@@ -340,12 +371,20 @@ func (d *Device) GetFileByPath(path string) (*File, error) {
 			return nil, err
 		}
 
-		entry, found := files[dir]
-		if !found {
+		var entry *File
+
+		for i := range files {
+			if files[i].Name == dir {
+				entry = &files[i]
+				break
+			}
+		}
+
+		if entry == nil {
 			return nil, fmt.Errorf("path component %s not found: %w", dir, ErrorInvalidOperation)
 		}
 
-		current = &entry
+		current = entry
 	}
 
 	return current, nil
@@ -23,16 +23,35 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mnencia/mchfuse/storage"
 )
 
 const (
-	DirectoryMimeType = "application/x.wd.dir"
+	DirectoryMimeType = storage.DirectoryMimeType
 	FileFields        = "id,eTag,parentID,childCount,mimeType,name,size,mTime,cTime"
 )
 
-var ErrorInvalidOperation = errors.New("invalid operation")
+// MaxWriteGap is the largest hole, in bytes, that Write fills with zeros
+// when writing past the end of a file.
+const MaxWriteGap = 64 << 30
+
+// maxWriteAttempts is how many times Write tries to fill a hole in a file
+// changed by other clients.
+const maxWriteAttempts = 3
+
+var (
+	ErrorInvalidOperation   = errors.New("invalid operation")
+	ErrorWriteGapTooBig     = storage.ErrorWriteGapTooBig
+	ErrorDirectoryNotEmpty  = errors.New("directory not empty")
+	ErrorFileNotFound       = storage.ErrorFileNotFound
+	ErrorPreconditionFailed = storage.ErrorPreconditionFailed
+)
 
 type File struct {
 	ID         string  `json:"id"`
@@ -56,35 +75,148 @@ type FileList struct {
 	device    *Device
 }
 
+// RequestOption customizes the requests changing a file.
+type RequestOption func(req *http.Request)
+
+// IfMatch makes the request fail with ErrorPreconditionFailed if the ETag
+// of the file on the device is not the given one, which means that the
+// file has been changed by another client. An empty ETag is ignored.
+func IfMatch(etag string) RequestOption {
+	return func(req *http.Request) {
+		if etag != "" {
+			req.Header.Set("If-Match", `"`+etag+`"`)
+		}
+	}
+}
+
+// applyOptions returns a request mutator calling mutator and then applying
+// the options.
+func applyOptions(mutator func(req *http.Request), opts []RequestOption) func(req *http.Request) {
+	return func(req *http.Request) {
+		if mutator != nil {
+			mutator(req)
+		}
+
+		for _, opt := range opts {
+			opt(req)
+		}
+	}
+}
+
+// hasPrecondition returns whether the options make the request conditional.
+func hasPrecondition(opts []RequestOption) bool {
+	req := &http.Request{Header: make(http.Header), URL: &url.URL{}}
+	applyOptions(nil, opts)(req)
+
+	return req.Header.Get("If-Match") != ""
+}
+
+// checkPrecondition returns ErrorPreconditionFailed if the response reports
+// that the precondition of the request doesn't hold.
+func checkPrecondition(resp *http.Response, id string) error {
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("file %v changed on the device: %w", id, ErrorPreconditionFailed)
+	}
+
+	return nil
+}
+
 func (f *File) IsDirectory() bool {
 	return f.MimeType == DirectoryMimeType
 }
 
-func (f *File) ListDirectory() (map[string]File, error) {
+// ListDirectory returns the content of the directory in the order returned
+// by the device. The device doesn't enforce unique names inside a directory,
+// and names are not checked to be valid on a POSIX filesystem.
+func (f *File) ListDirectory() ([]File, error) {
+	var files []File
+
+	iter := f.IterateDirectory()
+	for iter.Next() {
+		files = append(files, iter.Page()...)
+	}
+
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// ListDirectoryPage returns a page of the content of the directory. The
+// first page is returned for an empty token, and the PageToken of the
+// result is the one of the next page, or empty if this is the last one.
+func (f *File) ListDirectoryPage(pageToken string) (*FileList, error) {
 	if !f.IsDirectory() {
 		return nil, fmt.Errorf("%s is not a directory: %w", f.Name, ErrorInvalidOperation)
 	}
 
-	files := make(map[string]File)
-	pageToken := ""
+	return f.device.fileSearchParents(f.ID, pageToken)
+}
+
+// DirectoryIterator returns the content of a directory one page at a time,
+// as it is received from the device:
+//
+//	iter := dir.IterateDirectory()
+//	for iter.Next() {
+//		for _, file := range iter.Page() {
+//			...
+//		}
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+type DirectoryIterator struct {
+	dir       *File
+	page      []File
+	pageToken string
+	done      bool
+	err       error
+}
 
-	for {
-		fileList, err := f.device.fileSearchParents(f.ID, pageToken)
-		if err != nil {
-			return nil, err
-		}
+// IterateDirectory returns an iterator over the content of the directory.
+func (f *File) IterateDirectory() *DirectoryIterator {
+	return &DirectoryIterator{dir: f}
+}
 
-		for _, item := range fileList.Files {
-			files[item.Name] = item
-		}
+// Next fetches the next page, returning false when there are no more pages
+// or an error occurred.
+func (it *DirectoryIterator) Next() bool {
+	if it.done {
+		return false
+	}
 
-		pageToken = fileList.PageToken
-		if pageToken == "" {
-			break
-		}
+	fileList, err := it.dir.ListDirectoryPage(it.pageToken)
+	if err != nil {
+		it.page = nil
+		it.err = err
+		it.done = true
+
+		return false
 	}
 
-	return files, nil
+	it.page = fileList.Files
+	it.pageToken = fileList.PageToken
+	it.done = it.pageToken == ""
+
+	return true
+}
+
+// Page returns the files in the current page.
+func (it *DirectoryIterator) Page() []File {
+	return it.page
+}
+
+// PageToken returns the token of the page following the current one, which
+// can be passed to ListDirectoryPage to resume the listing. It is empty
+// after the last page.
+func (it *DirectoryIterator) PageToken() string {
+	return it.pageToken
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *DirectoryIterator) Err() error {
+	return it.err
 }
 
 func (f *File) LookupDirectory(name string) (*File, error) {
@@ -100,6 +232,29 @@ func (f *File) LookupDirectory(name string) (*File, error) {
 	return child, nil
 }
 
+// LookupDirectoryByID returns the child of the directory with the given ID,
+// or nil if the directory has no such child.
+func (f *File) LookupDirectoryByID(id string) (*File, error) {
+	if !f.IsDirectory() {
+		return nil, fmt.Errorf("%s is not a directory: %w", f.Name, ErrorInvalidOperation)
+	}
+
+	child, err := f.device.GetFileByID(id)
+	if errors.Is(err, ErrorFileNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if child.ParentID != f.ID {
+		return nil, nil
+	}
+
+	return child, nil
+}
+
 func (f *File) Refresh() error {
 	_, err := f.device.fileByID(f.ID, f)
 	if err != nil {
@@ -141,6 +296,109 @@ func (f *File) Delete() error {
 	return nil
 }
 
+// IsEmpty reports whether the directory has no children. The metadata of the
+// directory is refreshed, and its content is listed, to avoid deciding on
+// stale information.
+func (f *File) IsEmpty() (bool, error) {
+	if !f.IsDirectory() {
+		return false, fmt.Errorf("%s is not a directory: %w", f.Name, ErrorInvalidOperation)
+	}
+
+	if err := f.Refresh(); err != nil {
+		return false, err
+	}
+
+	if f.ChildCount > 0 {
+		return false, nil
+	}
+
+	fileList, err := f.device.fileSearchParents(f.ID, "")
+	if err != nil {
+		return false, err
+	}
+
+	return len(fileList.Files) == 0 && fileList.PageToken == "", nil
+}
+
+// DeleteProgressFunc is called by DeleteRecursive after every attempt to
+// delete a file, with the error raised if the attempt failed.
+type DeleteProgressFunc func(file *File, err error)
+
+// DeleteFailure is a file DeleteRecursive has been unable to delete.
+type DeleteFailure struct {
+	File *File
+	Err  error
+}
+
+// DeleteError is returned by DeleteRecursive when some of the files could
+// not be deleted. Directories containing such files are not deleted.
+type DeleteError struct {
+	Failures []DeleteFailure
+}
+
+func (e *DeleteError) Error() string {
+	if len(e.Failures) == 1 {
+		return fmt.Sprintf("error deleting %v: %v", e.Failures[0].File.Name, e.Failures[0].Err)
+	}
+
+	return fmt.Sprintf("error deleting %v files, first was %v: %v",
+		len(e.Failures), e.Failures[0].File.Name, e.Failures[0].Err)
+}
+
+// DeleteRecursive deletes the file and, if it is a directory, its whole
+// content, starting from the leaves. Failures do not stop the process:
+// they are reported to the progress function, if not nil, and returned
+// in a *DeleteError at the end.
+func (f *File) DeleteRecursive(progress DeleteProgressFunc) error {
+	var failures []DeleteFailure
+
+	f.deleteRecursive(func(file *File, err error) {
+		if err != nil {
+			failures = append(failures, DeleteFailure{File: file, Err: err})
+		}
+
+		if progress != nil {
+			progress(file, err)
+		}
+	})
+
+	if len(failures) > 0 {
+		return &DeleteError{Failures: failures}
+	}
+
+	return nil
+}
+
+// deleteRecursive deletes the file and its content, returning whether
+// the file has been deleted.
+func (f *File) deleteRecursive(report DeleteProgressFunc) bool {
+	if f.IsDirectory() {
+		children, err := f.ListDirectory()
+		if err != nil {
+			report(f, err)
+			return false
+		}
+
+		complete := true
+
+		for _, child := range children {
+			// Pin the variable
+			child := child
+			complete = child.deleteRecursive(report) && complete
+		}
+
+		if !complete {
+			report(f, fmt.Errorf("%s: %w", f.Name, ErrorDirectoryNotEmpty))
+			return false
+		}
+	}
+
+	err := f.Delete()
+	report(f, err)
+
+	return err == nil
+}
+
 func (f *File) Rename(newParent *File, newName string) error {
 	reqJSON := map[string]interface{}{
 		"parentID": newParent.ID,
@@ -169,7 +427,7 @@ func (f *File) Rename(newParent *File, newName string) error {
 	return nil
 }
 
-func (f *File) patch(reqJSON map[string]interface{}) (*http.Response, error) {
+func (f *File) patch(reqJSON map[string]interface{}, opts ...RequestOption) (*http.Response, error) {
 	data, err := json.Marshal(reqJSON)
 	if err != nil {
 		return nil, err
@@ -179,9 +437,9 @@ func (f *File) patch(reqJSON map[string]interface{}) (*http.Response, error) {
 		"PATCH",
 		fmt.Sprintf("/v2/files/%s", f.ID),
 		bytes.NewBuffer(data),
-		func(req *http.Request) {
+		applyOptions(func(req *http.Request) {
 			req.Header.Add("Content-Type", "application/json")
-		},
+		}, opts),
 	)
 	if err != nil {
 		return nil, err
@@ -233,6 +491,9 @@ func (f *File) CreateDirectory(name string) (*File, error) {
 	return f.device.fileByID(newID, &File{})
 }
 
+// Read reads up to len(dest) bytes starting at offset. It returns io.EOF
+// when offset is at or beyond the end of the file. The Size and ETag of the
+// file are updated with the values reported by the device in the response.
 func (f *File) Read(dest []byte, offset int64) (int, error) {
 	if f.IsDirectory() {
 		return 0, fmt.Errorf("%s is a directory: %w", f.Name, ErrorInvalidOperation)
@@ -259,7 +520,14 @@ func (f *File) Read(dest []byte, offset int64) (int, error) {
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusPartialContent {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The requested range starts past the end of the file
+		f.updateFromContentHeaders(resp.Header)
+
+		return 0, io.EOF
+	default:
 		return 0, fmt.Errorf(
 			"status code %v reading file %v offset %v size %v at %v: %w",
 			resp.StatusCode,
@@ -271,22 +539,66 @@ func (f *File) Read(dest []byte, offset int64) (int, error) {
 		)
 	}
 
-	b := bytes.NewBuffer(dest[:0])
+	f.updateFromContentHeaders(resp.Header)
 
-	n, err := io.Copy(b, resp.Body)
-	if err != nil {
+	n, err := io.ReadFull(resp.Body, dest)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
 		return 0, err
 	}
 
-	return int(n), nil
+	// The range is shorter than requested at the end of the file, but the
+	// body must be as long as announced, otherwise the connection dropped
+	if err != nil && resp.ContentLength > int64(n) {
+		return 0, fmt.Errorf("reading file %v offset %v: received %v of %v bytes: %w",
+			f.ID, offset, n, resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+
+	return n, nil
+}
+
+// updateFromContentHeaders refreshes the cached Size and ETag using the
+// headers of a content response.
+func (f *File) updateFromContentHeaders(header http.Header) {
+	if size, ok := parseContentRangeSize(header.Get("Content-Range")); ok {
+		f.Size = size
+	}
+
+	if etag := header.Get("Etag"); etag != "" {
+		f.ETag = strings.Trim(etag, `"`)
+	}
+}
+
+// updateETag sets the ETag of the file to the one in the headers of the
+// response to a change, clearing it if the device didn't send it.
+func (f *File) updateETag(header http.Header) {
+	f.ETag = strings.Trim(header.Get("Etag"), `"`)
 }
 
 func (f *File) Create(name string) (*File, error) {
-	reqJSON := map[string]string{
+	return f.CreateWithMeta(name, nil)
+}
+
+// CreateWithTimes creates an empty file with the given modification and
+// creation times.
+func (f *File) CreateWithTimes(name string, mTime time.Time, cTime time.Time) (*File, error) {
+	return f.CreateWithMeta(name, map[string]interface{}{
+		"mTime": ISOTime(mTime),
+		"cTime": ISOTime(cTime),
+	})
+}
+
+// CreateWithMeta creates an empty file, adding the given metadata
+// (e.g. mimeType) to the ones sent in the creation request.
+func (f *File) CreateWithMeta(name string, meta map[string]interface{}) (*File, error) {
+	reqJSON := map[string]interface{}{
 		"parentID": f.ID,
 		"name":     name,
 	}
 
+	for key, value := range meta {
+		reqJSON[key] = value
+	}
+
 	multipartBody, err := NewMultipartBody(reqJSON)
 	if err != nil {
 		return nil, err
@@ -327,26 +639,83 @@ func (f *File) Create(name string) (*File, error) {
 	return f.device.fileByID(newID, &File{})
 }
 
-func (f *File) Write(data []byte, offset int64) error {
+// Write writes data at the given offset. If the offset is past the end of
+// the file, the hole is filled with zeros, which are streamed to the device
+// together with the data.
+func (f *File) Write(data []byte, offset int64, opts ...RequestOption) error {
+	// The hole starts at the size of the file read before the write, so
+	// filling it would overwrite the data written in the meantime by other
+	// clients. The write is then conditional to the ETag read with the size,
+	// and it is sent again if the file changed, unless the caller already
+	// made it conditional.
+	retry := !hasPrecondition(opts)
+
+	for attempt := 1; ; attempt++ {
+		filled, err := f.write(data, offset, opts)
+		if !filled || !retry || attempt >= maxWriteAttempts || !errors.Is(err, ErrorPreconditionFailed) {
+			return err
+		}
+	}
+}
+
+// write sends a single write request, returning whether a hole was filled.
+func (f *File) write(data []byte, offset int64, opts []RequestOption) (bool, error) {
+	var body io.Reader = bytes.NewReader(data)
+
+	length := int64(len(data))
+	filled := false
+
+	if offset > int64(f.Size) {
+		// The cached size could be stale, and filling the hole starting from
+		// it would overwrite data written by other clients
+		if err := f.Refresh(); err != nil {
+			return false, err
+		}
+	}
+
+	if size := int64(f.Size); offset > size {
+		gap := offset - size
+		if gap > MaxWriteGap {
+			return false, fmt.Errorf("writing file %v at offset %v would leave a hole of %v bytes: %w",
+				f.ID, offset, gap, ErrorWriteGapTooBig)
+		}
+
+		body = io.MultiReader(io.LimitReader(zeroReader{}, gap), body)
+		length += gap
+		offset = size
+		filled = true
+		opts = append([]RequestOption{IfMatch(f.ETag)}, opts...)
+	}
+
+	if length == 0 {
+		return false, nil
+	}
+
 	resp, err := f.device.api(
 		"POST",
 		fmt.Sprintf("/v2/files/%s/resumable", f.ID),
-		bytes.NewBuffer(data),
-		func(req *http.Request) {
+		body,
+		applyOptions(func(req *http.Request) {
+			req.ContentLength = length
+
 			q := req.URL.Query()
 			q.Add("done", "true")
 			q.Add("offset", strconv.FormatInt(offset, 10))
 			req.URL.RawQuery = q.Encode()
-		},
+		}, opts),
 	)
 	if err != nil {
-		return err
+		return filled, err
 	}
 
 	defer resp.Body.Close()
 
+	if err := checkPrecondition(resp, f.ID); err != nil {
+		return filled, err
+	}
+
 	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf(
+		return filled, fmt.Errorf(
 			"status code %v writing file %v at %v: %w",
 			resp.StatusCode,
 			f.ID,
@@ -355,21 +724,37 @@ func (f *File) Write(data []byte, offset int64) error {
 		)
 	}
 
-	return nil
+	if end := uint64(offset + length); end > f.Size {
+		f.Size = end
+	}
+
+	f.updateETag(resp.Header)
+
+	return filled, nil
+}
+
+// Allocate makes sure the file is at least size bytes long, extending it
+// with zeros if needed.
+func (f *File) Allocate(size int64, opts ...RequestOption) error {
+	if size <= int64(f.Size) {
+		return nil
+	}
+
+	return f.Write(nil, size, opts...)
 }
 
-func (f *File) Truncate(offset int64) error {
+func (f *File) Truncate(offset int64, opts ...RequestOption) error {
 	resp, err := f.device.api(
 		"POST",
 		fmt.Sprintf("/v2/files/%s/resumable", f.ID),
 		nil,
-		func(req *http.Request) {
+		applyOptions(func(req *http.Request) {
 			q := req.URL.Query()
 			q.Add("done", "true")
 			q.Add("truncate", "true")
 			q.Add("offset", strconv.FormatInt(offset, 10))
 			req.URL.RawQuery = q.Encode()
-		},
+		}, opts),
 	)
 	if err != nil {
 		return err
@@ -377,6 +762,10 @@ func (f *File) Truncate(offset int64) error {
 
 	defer resp.Body.Close()
 
+	if err := checkPrecondition(resp, f.ID); err != nil {
+		return err
+	}
+
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf(
 			"status code %v writing file %v at %v: %w",
@@ -387,17 +776,24 @@ func (f *File) Truncate(offset int64) error {
 		)
 	}
 
+	f.Size = uint64(offset)
+	f.updateETag(resp.Header)
+
 	return nil
 }
 
-func (f *File) SetMeta(reqJSON map[string]interface{}) error {
-	resp, err := f.patch(reqJSON)
+func (f *File) SetMeta(reqJSON map[string]interface{}, opts ...RequestOption) error {
+	resp, err := f.patch(reqJSON, opts...)
 	if err != nil {
 		return err
 	}
 
 	defer resp.Body.Close()
 
+	if err := checkPrecondition(resp, f.ID); err != nil {
+		return err
+	}
+
 	if resp.StatusCode != http.StatusNoContent {
 		return fmt.Errorf(
 			"status code %v patching %v at %v: %w",
@@ -408,5 +804,7 @@ func (f *File) SetMeta(reqJSON map[string]interface{}) error {
 		)
 	}
 
+	f.updateETag(resp.Header)
+
 	return nil
 }
@@ -0,0 +1,297 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mch_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+func TestWriteHoleChanged(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("0123"))
+	other := openFile(t, server, server.Client().Transport, id)
+
+	// Another client extends the file right before the first write filling
+	// the hole is received, after its size has been read
+	var once sync.Once
+
+	extend := func(next http.RoundTripper) http.RoundTripper {
+		return mch.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/resumable") {
+				once.Do(func() {
+					if err := other.Write([]byte("4567"), 4); err != nil {
+						t.Error(err)
+					}
+				})
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+
+	file := openFile(t, server, server.Client().Transport, id, extend)
+
+	if err := file.Write([]byte("X"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := server.Content(id); string(content) != "01234567\x00\x00X" {
+		t.Errorf("content is %q", content)
+	}
+
+	// Writes made conditional by the caller are not sent again
+	once = sync.Once{}
+
+	if err := file.Write([]byte("Y"), 20, mch.IfMatch(file.ETag)); !errors.Is(err, mch.ErrorPreconditionFailed) {
+		t.Errorf("conditional write of a changed file returned %v", err)
+	}
+
+	if content, _ := server.Content(id); len(content) != 11 {
+		t.Errorf("content is %q", content)
+	}
+}
+
+func TestRead(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("0123456789"))
+	file := openFile(t, server, server.Client().Transport, id)
+	other := openFile(t, server, server.Client().Transport, id)
+
+	tests := []struct {
+		name    string
+		change  func() error
+		offset  int64
+		content string
+		err     error
+		size    uint64
+	}{
+		{name: "inside", offset: 2, content: "2345", size: 10},
+		{name: "across the end", offset: 8, content: "89", size: 10},
+		{name: "at the end", offset: 10, err: io.EOF, size: 10},
+		{
+			name:    "grown by another client",
+			change:  func() error { return other.Write([]byte("abcdef"), 10) },
+			offset:  10,
+			content: "abcd",
+			size:    16,
+		},
+		{
+			name:   "shrunk by another client",
+			change: func() error { return other.Truncate(4) },
+			offset: 6,
+			err:    io.EOF,
+			size:   4,
+		},
+	}
+
+	for _, test := range tests {
+		etag := file.ETag
+
+		if test.change != nil {
+			if err := test.change(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dest := make([]byte, 4)
+
+		n, err := file.Read(dest, test.offset)
+		if !errors.Is(err, test.err) || string(dest[:n]) != test.content {
+			t.Errorf("%v: read %q (%v) instead of %q (%v)", test.name, dest[:n], err, test.content, test.err)
+		}
+
+		// The size and the ETag are refreshed by every read
+		if file.Size != test.size {
+			t.Errorf("%v: the size is %v instead of %v", test.name, file.Size, test.size)
+		}
+
+		if changed := file.ETag != etag; changed != (test.change != nil) {
+			t.Errorf("%v: the ETag changed from %q to %q", test.name, etag, file.ETag)
+		}
+	}
+}
+
+func TestHidden(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	server.AddDirectory(mchtest.RootID, "dir")
+
+	client, err := server.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceInfo, err := client.DeviceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := deviceInfo.Find("mchtest").Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files hidden for the OS of the client are excluded by default
+	for _, hidden := range []string{client.OSType, mch.HiddenAll, mch.HiddenNone} {
+		client.Hidden = hidden
+
+		server.ResetRequests()
+
+		if _, err := root.ListDirectory(); err != nil {
+			t.Fatal(err)
+		}
+
+		if dir, err := root.LookupDirectory("dir"); err != nil || dir == nil {
+			t.Fatalf("lookup returned %v, %v", dir, err)
+		}
+
+		for _, endpoint := range []string{"parents", "parentAndName"} {
+			queries := server.Queries(http.MethodGet, "/sdk/v2/filesSearch/"+endpoint)
+			if len(queries) != 1 || queries[0].Get("hidden") != hidden {
+				t.Errorf("searched by %v with %v instead of hidden=%v", endpoint, queries, hidden)
+			}
+		}
+	}
+}
+
+func TestIsEmpty(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	emptyID := server.AddDirectory(mchtest.RootID, "empty")
+	fullID := server.AddDirectory(mchtest.RootID, "full")
+	fileID := server.AddFile(fullID, "file", []byte("content"))
+
+	tests := []struct {
+		id    string
+		empty bool
+		err   error
+	}{
+		{id: emptyID, empty: true},
+		{id: fullID},
+		{id: fileID, err: mch.ErrorInvalidOperation},
+	}
+
+	for _, tt := range tests {
+		file := openFile(t, server, server.Client().Transport, tt.id)
+
+		empty, err := file.IsEmpty()
+		if empty != tt.empty || !errors.Is(err, tt.err) {
+			t.Errorf("%v: IsEmpty returned %v, %v instead of %v, %v", file.Name, empty, err, tt.empty, tt.err)
+		}
+	}
+}
+
+func TestDeleteRecursive(t *testing.T) {
+	tests := []struct {
+		name string
+		// failing is the name of the file whose deletion fails
+		failing string
+		// kept are the names of the files left on the device
+		kept []string
+	}{
+		{name: "success"},
+		{name: "partial failure", failing: "b", kept: []string{"dir", "sub", "b"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			server := mchtest.NewServer()
+			defer server.Close()
+
+			dirID := server.AddDirectory(mchtest.RootID, "dir")
+			subID := server.AddDirectory(dirID, "sub")
+			ids := map[string]string{
+				"dir": dirID,
+				"sub": subID,
+				"a":   server.AddFile(dirID, "a", []byte("a")),
+				"b":   server.AddFile(subID, "b", []byte("b")),
+				"c":   server.AddFile(subID, "c", []byte("c")),
+			}
+
+			faults := mchfault.New(1)
+			if tt.failing != "" {
+				faults = mchfault.New(1, mchfault.Rule{
+					Method: http.MethodDelete,
+					Path:   "/sdk/v2/files/" + ids[tt.failing],
+					Fault:  mchfault.Fault{Status: http.StatusServiceUnavailable},
+				})
+			}
+
+			faults.Transport = server.Client().Transport
+			dir := openFile(t, server, faults, dirID)
+
+			var attempts []string
+
+			err := dir.DeleteRecursive(func(file *mch.File, err error) {
+				attempts = append(attempts, file.Name)
+			})
+
+			// Every file is attempted, and the directories containing
+			// the failing one are reported as not empty
+			if len(attempts) != len(ids) {
+				t.Errorf("attempted to delete %v", attempts)
+			}
+
+			var deleteErr *mch.DeleteError
+
+			switch {
+			case tt.failing == "" && err != nil:
+				t.Errorf("DeleteRecursive returned %v", err)
+			case tt.failing != "" && !errors.As(err, &deleteErr):
+				t.Errorf("DeleteRecursive returned %v instead of a DeleteError", err)
+			case tt.failing != "":
+				if len(deleteErr.Failures) != len(tt.kept) {
+					t.Errorf("DeleteRecursive failures are %v", deleteErr.Failures)
+				}
+
+				for _, failure := range deleteErr.Failures {
+					if failure.File.IsDirectory() && !errors.Is(failure.Err, mch.ErrorDirectoryNotEmpty) {
+						t.Errorf("%v failed with %v", failure.File.Name, failure.Err)
+					}
+				}
+			}
+
+			kept := make(map[string]bool)
+			for _, name := range tt.kept {
+				kept[name] = true
+			}
+
+			for name, id := range ids {
+				if _, found := server.Content(id); found != kept[name] {
+					t.Errorf("%v kept: %v", name, found)
+				}
+			}
+		})
+	}
+}
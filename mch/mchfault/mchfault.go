@@ -0,0 +1,238 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mchfault injects faults in the HTTP requests sent to the My Cloud
+// Home services, to check how the code using the mch package handles slow
+// or failing connections and errors of the services.
+package mchfault
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+var ErrorInjected = errors.New("injected fault")
+
+// Fault is what happens to a request. The zero value sends the request
+// unchanged.
+type Fault struct {
+	// Latency delays the request.
+	Latency time.Duration
+
+	// Error makes the request fail with ErrorInjected, without sending it,
+	// as if the connection was dropped.
+	Error bool
+
+	// Status, if not zero, is the status code of the response returned
+	// without sending the request, as if returned by a relay.
+	Status int
+
+	// Truncate makes the response body fail with io.ErrUnexpectedEOF
+	// after TruncateAfter bytes, or at its end if shorter, as if the
+	// connection was dropped while receiving it.
+	Truncate      bool
+	TruncateAfter int64
+}
+
+// Rule selects the requests a Fault is applied to.
+type Rule struct {
+	// Method and Path select the requests. The Path is a pattern with
+	// the syntax of path.Match, matched against the path of the URL.
+	// Empty values match every request.
+	Method string
+	Path   string
+
+	// Probability is the probability of the fault being applied to a
+	// matching request. Zero means always.
+	Probability float64
+
+	// Times, if not zero, is how many times the fault is applied, after
+	// which the rule is ignored. Consecutive rules with the same requests
+	// are a script of the faults applied to them.
+	Times int
+
+	Fault Fault
+}
+
+// Transport is an http.RoundTripper applying to each request the fault
+// of the first rule matching it, and sending the others unchanged. Faults
+// are chosen with a pseudo-random source with a fixed seed, so they are
+// the same when the requests are sent in the same order. It is safe for
+// concurrent use.
+type Transport struct {
+	// Transport sends the requests. It defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	mu      sync.Mutex
+	rules   []Rule
+	applied []int
+	random  *rand.Rand
+}
+
+var _ http.RoundTripper = (*Transport)(nil)
+
+// New returns a transport applying the given rules, choosing the faults
+// with the given seed.
+func New(seed int64, rules ...Rule) *Transport {
+	return &Transport{
+		rules:   rules,
+		applied: make([]int, len(rules)),
+		random:  rand.New(rand.NewSource(seed)), // nolint:gosec
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	fault := t.fault(req)
+
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			closeBody(req)
+
+			return nil, req.Context().Err()
+		}
+	}
+
+	if fault.Error {
+		closeBody(req)
+
+		return nil, fmt.Errorf("%w sending %v %v", ErrorInjected, req.Method, req.URL)
+	}
+
+	if fault.Status != 0 {
+		closeBody(req)
+
+		return response(req, fault.Status), nil
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if fault.Truncate {
+		resp.Body = &truncatedBody{
+			reader: io.LimitReader(resp.Body, fault.TruncateAfter),
+			closer: resp.Body,
+		}
+	}
+
+	return resp, nil
+}
+
+// fault returns the fault to apply to the request.
+func (t *Transport) fault(req *http.Request) Fault {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := range t.rules {
+		rule := &t.rules[i]
+
+		if rule.Times > 0 && t.applied[i] >= rule.Times {
+			continue
+		}
+
+		if !rule.matches(req) {
+			continue
+		}
+
+		if rule.Probability > 0 && t.random.Float64() >= rule.Probability {
+			continue
+		}
+
+		t.applied[i]++
+
+		return rule.Fault
+	}
+
+	return Fault{}
+}
+
+func (r *Rule) matches(req *http.Request) bool {
+	if r.Method != "" && r.Method != req.Method {
+		return false
+	}
+
+	if r.Path == "" {
+		return true
+	}
+
+	matched, err := path.Match(r.Path, req.URL.Path)
+
+	return err == nil && matched
+}
+
+// closeBody closes the body of a request which is not sent, as the
+// transport would.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+// response returns a response with the given status code and a body
+// describing it.
+func response(req *http.Request, status int) *http.Response {
+	body := []byte(http.StatusText(status))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// truncatedBody is a response body failing after a number of bytes.
+type truncatedBody struct {
+	reader io.Reader
+	closer io.Closer
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mchfault_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+func newServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+}
+
+func get(client *http.Client, url string) (int, string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(body), err
+}
+
+func TestScript(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	transport := mchfault.New(1,
+		mchfault.Rule{Path: "/files/*", Times: 2, Fault: mchfault.Fault{Status: http.StatusServiceUnavailable}},
+		mchfault.Rule{Path: "/files/*", Times: 1, Fault: mchfault.Fault{Error: true}},
+		mchfault.Rule{Path: "/files/*", Times: 1, Fault: mchfault.Fault{Truncate: true, TruncateAfter: 4}},
+	)
+	client := &http.Client{Transport: transport}
+
+	// Other requests are not affected
+	if status, body, err := get(client, server.URL+"/other"); status != http.StatusOK || body != "0123456789" {
+		t.Errorf("unmatched request returned %v, %q, %v", status, body, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, _, err := get(client, server.URL+"/files/1"); status != http.StatusServiceUnavailable {
+			t.Errorf("request %d returned %v, %v instead of 503", i, status, err)
+		}
+	}
+
+	if _, _, err := get(client, server.URL+"/files/1"); !errors.Is(err, mchfault.ErrorInjected) {
+		t.Errorf("dropped request returned %v", err)
+	}
+
+	if _, body, err := get(client, server.URL+"/files/1"); body != "0123" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated request returned %q, %v", body, err)
+	}
+
+	// The script is over
+	if status, body, err := get(client, server.URL+"/files/1"); status != http.StatusOK || body != "0123456789" {
+		t.Errorf("request after the script returned %v, %q, %v", status, body, err)
+	}
+}
+
+func TestProbability(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	failures := func() []bool {
+		transport := mchfault.New(42, mchfault.Rule{Probability: 0.5, Fault: mchfault.Fault{Error: true}})
+		client := &http.Client{Transport: transport}
+
+		var failed []bool
+
+		for i := 0; i < 20; i++ {
+			_, _, err := get(client, server.URL)
+			failed = append(failed, err != nil)
+		}
+
+		return failed
+	}
+
+	first, second := failures(), failures()
+	count := 0
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("the faults are not the same with the same seed: %v, %v", first, second)
+		}
+
+		if first[i] {
+			count++
+		}
+	}
+
+	if count == 0 || count == len(first) {
+		t.Errorf("%d requests of %d failed", count, len(first))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+
+	transport := mchfault.New(1, mchfault.Rule{Fault: mchfault.Fault{Latency: time.Minute}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("stalled request returned %v", err)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := mchfault.ParseRules("path=/sdk/v2/files/*/resumable,method=post,status=503,times=2; " +
+		"latency=30s,probability=0.1;error;truncate=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []mchfault.Rule{
+		{
+			Method: http.MethodPost, Path: "/sdk/v2/files/*/resumable", Times: 2,
+			Fault: mchfault.Fault{Status: http.StatusServiceUnavailable},
+		},
+		{Probability: 0.1, Fault: mchfault.Fault{Latency: 30 * time.Second}},
+		{Fault: mchfault.Fault{Error: true}},
+		{Fault: mchfault.Fault{Truncate: true, TruncateAfter: 100}},
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("parsed %+v", rules)
+	}
+
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("rule %d is %+v instead of %+v", i, rules[i], expected[i])
+		}
+	}
+
+	for _, spec := range []string{"status=bad", "unknown=1", "path=[", "latency"} {
+		if _, err := mchfault.ParseRules(spec); !errors.Is(err, mchfault.ErrorInvalidRule) {
+			t.Errorf("parsing %q returned %v", spec, err)
+		}
+	}
+}
+
+// TestDeviceWrite shows how the mch client reacts to the faults of the
+// device while writing a file.
+func TestDeviceWrite(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	transport := mchfault.New(1,
+		mchfault.Rule{Method: http.MethodPost, Path: "/sdk/v2/files/*/resumable", Times: 1,
+			Fault: mchfault.Fault{Status: http.StatusServiceUnavailable}},
+		mchfault.Rule{Path: "/sdk/v3/files/*/content", Times: 1,
+			Fault: mchfault.Fault{Truncate: true, TruncateAfter: 2}},
+	)
+	transport.Transport = server.Client().Transport
+
+	client, err := mch.Login("user", "password",
+		mch.WithHTTPClient(&http.Client{Transport: transport}),
+		mch.WithConfigurationURL(server.ConfigurationURL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceInfo, err := client.DeviceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := deviceInfo.Find("mchtest").GetFileByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := file.Write([]byte("CONTENT"), 0); !errors.Is(err, mch.ErrorUnexpectedStatusCode) {
+		t.Errorf("write during an outage returned %v", err)
+	}
+
+	if content, _ := server.Content(id); string(content) != "content" {
+		t.Errorf("failed write changed the content to %q", content)
+	}
+
+	if err := file.Write([]byte("CONTENT"), 0); err != nil {
+		t.Errorf("write after the outage returned %v", err)
+	}
+
+	buf := make([]byte, 16)
+	if _, err := file.Read(buf, 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated read returned %v", err)
+	}
+}
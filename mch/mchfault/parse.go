@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mchfault
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrorInvalidRule = errors.New("invalid fault rule")
+
+// ParseRules parses rules written as a list separated by semicolons, each
+// one a list of key=value settings separated by commas. The keys are the
+// method, path, probability and times selecting the requests, and the
+// latency, error, status and truncate (the number of bytes received)
+// describing the fault. For example:
+//
+//	path=/sdk/v2/files/*/resumable,status=503,times=2;latency=30s,probability=0.1
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+
+	for _, text := range strings.Split(spec, ";") {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		rule, err := parseRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", text, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func parseRule(text string) (rule Rule, err error) { // nolint:gocyclo,cyclop
+	for _, setting := range strings.Split(text, ",") {
+		key, value := strings.TrimSpace(setting), ""
+		if i := strings.Index(key, "="); i >= 0 {
+			key, value = key[:i], key[i+1:]
+		}
+
+		switch key {
+		case "method":
+			rule.Method = strings.ToUpper(value)
+		case "path":
+			_, err = path.Match(value, "")
+			rule.Path = value
+		case "probability":
+			rule.Probability, err = strconv.ParseFloat(value, 64)
+		case "times":
+			rule.Times, err = strconv.Atoi(value)
+		case "latency":
+			rule.Fault.Latency, err = time.ParseDuration(value)
+		case "error":
+			rule.Fault.Error = true
+		case "status":
+			rule.Fault.Status, err = strconv.Atoi(value)
+		case "truncate":
+			rule.Fault.Truncate = true
+			rule.Fault.TruncateAfter, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return rule, fmt.Errorf("unknown setting %q: %w", key, ErrorInvalidRule)
+		}
+
+		if err != nil {
+			return rule, fmt.Errorf("setting %q: %v: %w", key, err, ErrorInvalidRule)
+		}
+	}
+
+	return rule, nil
+}
@@ -0,0 +1,433 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mchrecord records the HTTP requests sent to the My Cloud Home
+// services, with the tokens and the credentials redacted, and replays them,
+// to run the code using the mch package deterministically without the
+// services.
+//
+// The interactions are stored in fixture files as a sequence of JSON
+// documents, appended as soon as the body of each response has been read.
+// The bodies are streamed, recording only their beginning.
+package mchrecord
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// Interaction is a request sent to the services and the response received.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded HTTP request. Truncated is set if only the
+// beginning of the body has been recorded.
+type Request struct {
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header,omitempty"`
+	Body      Body        `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// Response is a recorded HTTP response. Truncated is set if only the
+// beginning of the body has been recorded, which is all the body replaying
+// the response.
+type Response struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       Body        `json:"body,omitempty"`
+	Truncated  bool        `json:"truncated,omitempty"`
+}
+
+// Body is the content of a request or of a response. It is stored as a
+// string if it is valid UTF-8, otherwise as an object with the content
+// encoded in base64.
+type Body []byte
+
+type encodedBody struct {
+	Base64 string `json:"base64"`
+}
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+
+	return json.Marshal(encodedBody{Base64: base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*b = Body(text)
+
+		return nil
+	}
+
+	var encoded encodedBody
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded.Base64)
+	if err != nil {
+		return err
+	}
+
+	*b = decoded
+
+	return nil
+}
+
+var ErrorNoInteraction = errors.New("no recorded interaction")
+
+// DefaultMaxBodySize is the default number of bytes recorded for each body.
+const DefaultMaxBodySize = 64 << 10
+
+// Recorder is an http.RoundTripper recording the requests it sends, and
+// the responses received, to a fixture. It is safe for concurrent use.
+//
+// The bodies are streamed while they are recorded, so the transfers of big
+// files are not kept in memory. An interaction is recorded when the body
+// of the response is read to the end or closed.
+type Recorder struct {
+	// Transport sends the requests. It defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	// MaxBodySize is the number of bytes recorded for each body, the rest
+	// being only sent. It defaults to DefaultMaxBodySize.
+	MaxBodySize int
+
+	mu      sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+var _ http.RoundTripper = (*Recorder)(nil)
+
+// NewRecorder returns a recorder writing the interactions to w.
+func NewRecorder(w io.Writer) *Recorder {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return &Recorder{encoder: encoder}
+}
+
+// Create returns a recorder writing the interactions to a new fixture file
+// with the given path. The caller should call Close when finished.
+func Create(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := NewRecorder(file)
+	recorder.closer = file
+
+	return recorder, nil
+}
+
+// Close closes the fixture file opened by Create.
+func (r *Recorder) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+
+	return r.closer.Close()
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	limit := r.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	sent := req.Clone(req.Context())
+	body := newCapture(req.Body, limit)
+
+	if req.Body != nil && req.Body != http.NoBody {
+		sent.Body = body
+	}
+
+	resp, err := transport.RoundTrip(sent)
+	if err != nil {
+		return nil, err
+	}
+
+	statusCode, header := resp.StatusCode, resp.Header.Clone()
+	respBody := newCapture(resp.Body, limit)
+	respBody.done = func() error {
+		reqData, reqTruncated := body.captured()
+		respData, respTruncated := respBody.captured()
+
+		return r.record(Interaction{
+			Request:  redactRequest(req, reqData, reqTruncated),
+			Response: redactResponse(statusCode, header, respData, respTruncated),
+		})
+	}
+	resp.Body = respBody
+
+	return resp, nil
+}
+
+func (r *Recorder) record(interaction Interaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.encoder.Encode(interaction); err != nil {
+		return fmt.Errorf("recording %v %v: %w", interaction.Request.Method, interaction.Request.URL, err)
+	}
+
+	return nil
+}
+
+// capture is a body keeping a copy of the first bytes read from it, up to
+// a limit. It calls done, if set, once the body has been read to the end
+// or closed.
+type capture struct {
+	body  io.ReadCloser
+	limit int
+
+	mu        sync.Mutex
+	data      []byte
+	truncated bool
+
+	done     func() error
+	doneOnce sync.Once
+	doneErr  error
+}
+
+func newCapture(body io.ReadCloser, limit int) *capture {
+	return &capture{body: body, limit: limit}
+}
+
+func (c *capture) Read(p []byte) (int, error) {
+	if c.body == nil {
+		return 0, io.EOF
+	}
+
+	n, err := c.body.Read(p)
+	c.save(p[:n])
+
+	if errors.Is(err, io.EOF) {
+		if doneErr := c.finish(); doneErr != nil {
+			return n, doneErr
+		}
+	}
+
+	return n, err
+}
+
+// Close records the part of the body not read yet, up to the limit, before
+// closing it, as the responses ignored by the client are part of the
+// interactions as well.
+func (c *capture) Close() error {
+	if c.body == nil {
+		return c.finish()
+	}
+
+	c.mu.Lock()
+	remaining := c.limit - len(c.data)
+	c.mu.Unlock()
+
+	if remaining >= 0 {
+		_, _ = io.Copy(ioutil.Discard, io.LimitReader(c, int64(remaining)+1))
+	}
+
+	err := c.body.Close()
+	if doneErr := c.finish(); err == nil {
+		err = doneErr
+	}
+
+	return err
+}
+
+func (c *capture) save(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if room := c.limit - len(c.data); len(p) > room {
+		p = p[:room]
+		c.truncated = true
+	}
+
+	c.data = append(c.data, p...)
+}
+
+// captured returns the bytes recorded, and whether the body was longer.
+func (c *capture) captured() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.data, c.truncated
+}
+
+func (c *capture) finish() error {
+	c.doneOnce.Do(func() {
+		if c.done != nil {
+			c.doneErr = c.done()
+		}
+	})
+
+	return c.doneErr
+}
+
+// Replayer is an http.RoundTripper answering the requests with the
+// recorded responses. A request gets the first response, not replayed yet,
+// recorded for a request with the same method, path and query. The host
+// is ignored, as the device can be reached with different addresses.
+// It is safe for concurrent use.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	replayed     []bool
+}
+
+var _ http.RoundTripper = (*Replayer)(nil)
+
+// NewReplayer returns a replayer answering with the given interactions.
+func NewReplayer(interactions []Interaction) *Replayer {
+	return &Replayer{
+		interactions: interactions,
+		replayed:     make([]bool, len(interactions)),
+	}
+}
+
+// Load returns a replayer answering with the interactions in the fixture
+// file with the given path.
+func Load(path string) (*Replayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	interactions, err := ReadInteractions(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading fixture %v: %w", path, err)
+	}
+
+	return NewReplayer(interactions), nil
+}
+
+// ReadInteractions reads the interactions written by a Recorder.
+func ReadInteractions(r io.Reader) ([]Interaction, error) {
+	var interactions []Interaction
+
+	decoder := json.NewDecoder(r)
+
+	for {
+		var interaction Interaction
+
+		err := decoder.Decode(&interaction)
+		if errors.Is(err, io.EOF) {
+			return interactions, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		interactions = append(interactions, interaction)
+	}
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The body is consumed, as a transport would do sending it
+	if req.Body != nil {
+		_, err := io.Copy(ioutil.Discard, req.Body)
+		_ = req.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.interactions {
+		if r.replayed[i] || !matches(&r.interactions[i].Request, req) {
+			continue
+		}
+
+		r.replayed[i] = true
+		recorded := r.interactions[i].Response
+
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+			StatusCode:    recorded.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        recorded.Header.Clone(),
+			Body:          ioutil.NopCloser(bytes.NewReader(recorded.Body)),
+			ContentLength: int64(len(recorded.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w for %v %v", ErrorNoInteraction, req.Method, req.URL)
+}
+
+// Remaining returns the number of interactions not replayed yet.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	remaining := 0
+
+	for _, replayed := range r.replayed {
+		if !replayed {
+			remaining++
+		}
+	}
+
+	return remaining
+}
+
+// matches reports whether the request has the same method, path and query
+// of the recorded one.
+func matches(recorded *Request, req *http.Request) bool {
+	if recorded.Method != req.Method {
+		return false
+	}
+
+	recordedURL, err := url.Parse(recorded.URL)
+	if err != nil {
+		return false
+	}
+
+	return recordedURL.Path == req.URL.Path && recordedURL.RawQuery == req.URL.RawQuery
+}
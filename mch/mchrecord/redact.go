@@ -0,0 +1,229 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mchrecord
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// Redacted replaces the secrets in the recorded interactions.
+	Redacted = "REDACTED"
+
+	// RedactedHost replaces the names of the device, keeping the port, so
+	// they are still valid host names, which are never resolved.
+	RedactedHost = "device.invalid"
+
+	// RedactedIP replaces the addresses of the device, so they are still
+	// valid addresses, reserved for documentation.
+	RedactedIP = "192.0.2.1"
+)
+
+// redactedExpiration is the expiration time of the tokens in the recorded
+// responses, far enough in the future for them to be never refreshed when
+// the interactions are replayed.
+const redactedExpiration = 4102444800 // 2100-01-01
+
+// secretFields are the fields of the JSON documents containing
+// credentials, which are replaced by Redacted.
+var secretFields = map[string]bool{ // nolint:gochecknoglobals
+	"username":      true,
+	"password":      true,
+	"client_secret": true,
+	"refresh_token": true,
+}
+
+// deviceFields are the fields of the JSON documents identifying the device
+// or its network, which are replaced by values of the same kind, so the
+// client can still parse them replaying the interactions.
+var deviceFields = map[string]func(string) string{ // nolint:gochecknoglobals
+	"serialNumber":      redactString,
+	"mac":               redactString,
+	"tunnelId":          redactString,
+	"localIpAddress":    redactIP,
+	"externalIpAddress": redactIP,
+	"internalDNSName":   redactHost,
+	"portForwardDomain": redactHost,
+	"internalURL":       redactURL,
+	"portForwardURL":    redactURL,
+	"proxyURL":          redactURL,
+	"externalURI":       redactURL,
+}
+
+// devicePathPrefix is the prefix of the paths of the requests sent to the
+// device, whose host name is redacted.
+const devicePathPrefix = "/sdk/"
+
+// tokenFields are the fields of the JSON documents containing the JWT
+// tokens, which are replaced by unsigned tokens with the same subject.
+var tokenFields = map[string]bool{ // nolint:gochecknoglobals
+	"access_token": true,
+	"id_token":     true,
+}
+
+func redactRequest(req *http.Request, body []byte, truncated bool) Request {
+	header := req.Header.Clone()
+
+	// The scheme is kept, only the credentials are removed
+	if auth := header.Get("Authorization"); auth != "" {
+		scheme := strings.SplitN(auth, " ", 2)[0]
+		header.Set("Authorization", scheme+" "+Redacted)
+	}
+
+	// The device can be reached with names identifying it
+	requestURL := *req.URL
+	if strings.HasPrefix(requestURL.Path, devicePathPrefix) {
+		requestURL.Host = redactHost(requestURL.Host)
+	}
+
+	return Request{
+		Method:    req.Method,
+		URL:       requestURL.String(),
+		Header:    header,
+		Body:      redactBody(body, truncated),
+		Truncated: truncated,
+	}
+}
+
+func redactResponse(statusCode int, header http.Header, body []byte, truncated bool) Response {
+	// The length of the body changes redacting it, and is set again from
+	// the body replaying the response
+	header = header.Clone()
+	header.Del("Set-Cookie")
+	header.Del("Content-Length")
+
+	return Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       redactBody(body, truncated),
+		Truncated:  truncated,
+	}
+}
+
+// redactBody removes the secrets and the identifiers of the device from a
+// JSON document, at any depth. Other bodies are returned unchanged, except
+// the truncated JSON documents, which cannot be parsed to redact them.
+func redactBody(body []byte, truncated bool) Body {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		if trimmed := bytes.TrimSpace(body); truncated && len(trimmed) > 0 && strings.ContainsRune("{[", rune(trimmed[0])) {
+			return Body(Redacted)
+		}
+
+		return body
+	}
+
+	if !redactValue(document) {
+		return body
+	}
+
+	result, err := json.Marshal(document)
+	if err != nil {
+		return Body(Redacted)
+	}
+
+	return result
+}
+
+// redactValue redacts the objects in the given JSON value, returning
+// whether something has been redacted.
+func redactValue(value interface{}) bool {
+	redacted := false
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			text, isText := field.(string)
+
+			switch {
+			case secretFields[key]:
+				value[key] = Redacted
+			case tokenFields[key]:
+				value[key] = redactToken(text)
+			case deviceFields[key] != nil && isText && text != "":
+				value[key] = deviceFields[key](text)
+			default:
+				redacted = redactValue(field) || redacted
+
+				continue
+			}
+
+			redacted = true
+		}
+	case []interface{}:
+		for _, element := range value {
+			redacted = redactValue(element) || redacted
+		}
+	}
+
+	return redacted
+}
+
+func redactString(string) string {
+	return Redacted
+}
+
+func redactIP(string) string {
+	return RedactedIP
+}
+
+// redactHost replaces the host name or the address, keeping the port.
+func redactHost(host string) string {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(RedactedHost, port)
+	}
+
+	return RedactedHost
+}
+
+// redactURL replaces the host name or the address in the URL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return Redacted
+	}
+
+	u.Host = redactHost(u.Host)
+
+	return u.String()
+}
+
+// redactToken returns an unsigned JWT token with the same subject of the
+// given one, and an expiration time in the far future.
+func redactToken(token string) string {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		return Redacted
+	}
+
+	redacted, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"sub": claims["sub"],
+		"exp": redactedExpiration,
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		return Redacted
+	}
+
+	return redacted
+}
@@ -0,0 +1,647 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mchtest provides a fake of the My Cloud Home services, to test
+// the code using the mch package without a real device.
+package mchtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"github.com/mnencia/mchfuse/mch"
+)
+
+// RootID is the ID of the root directory of the fake device.
+const RootID = "root"
+
+const (
+	userID     = "auth0|mchtest"
+	deviceName = "mchtest"
+	signingKey = "mchtest"
+)
+
+// Server is a fake of the cloud services and of the device, serving the
+// files it keeps in memory. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	// PageSize is the maximum number of files in a page of a directory
+	// listing. Zero means no limit.
+	PageSize int
+
+	mu       sync.Mutex
+	files    map[string]*entry
+	lastID   int
+	requests []request
+}
+
+// request is a request received by the server.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+}
+
+type entry struct {
+	mch.File
+	content []byte
+}
+
+// NewServer starts a fake with an empty root directory. The caller should
+// call Close when finished, to shut it down.
+func NewServer() *Server {
+	now := mch.ISOTime(time.Now())
+	s := &Server{
+		files: map[string]*entry{
+			RootID: {File: mch.File{
+				ID:       RootID,
+				ETag:     "1",
+				MimeType: mch.DirectoryMimeType,
+				MTime:    now,
+				CTime:    now,
+			}},
+		},
+		lastID: 1,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", s.serveConfiguration)
+	mux.HandleFunc("/oauth/token", s.serveToken)
+	mux.HandleFunc("/device/v1/user/", s.serveDeviceInfo)
+	mux.HandleFunc("/sdk/v2/filesSearch/parents", s.serveSearchParents)
+	mux.HandleFunc("/sdk/v2/filesSearch/parentAndName", s.serveSearchParentAndName)
+	mux.HandleFunc("/sdk/v2/files", s.serveCreate)
+	mux.HandleFunc("/sdk/v2/files/", s.serveFile)
+	mux.HandleFunc("/sdk/v3/files/", s.serveContent)
+
+	// The device is probed by opening and closing connections, which
+	// would fill the log with failed handshakes
+	s.Server = httptest.NewUnstartedServer(s.count(mux))
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+
+	return s
+}
+
+// count records the requests received by the handler.
+func (s *Server) count(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, request{method: r.Method, path: r.URL.Path, query: r.URL.Query()})
+		s.mu.Unlock()
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Requests returns the number of requests received with the given method,
+// or any method if empty, and a path matching the given pattern, in the
+// syntax of path.Match.
+func (s *Server) Requests(method, pattern string) int {
+	return len(s.Queries(method, pattern))
+}
+
+// Queries returns the query parameters of the requests received with the
+// given method, or any method if empty, and a path matching the given
+// pattern, in the syntax of path.Match, in the order they were received.
+func (s *Server) Queries(method, pattern string) []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var queries []url.Values
+
+	for _, r := range s.requests {
+		if matched, _ := path.Match(pattern, r.path); matched && (method == "" || method == r.method) {
+			queries = append(queries, r.query)
+		}
+	}
+
+	return queries
+}
+
+// ResetRequests forgets the requests received so far.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = nil
+}
+
+// ConfigurationURL returns the URL to pass to mch.WithConfigurationURL.
+func (s *Server) ConfigurationURL() string {
+	return s.URL + "/config"
+}
+
+// Login returns a client logged in to the fake. The options are applied
+// after the ones needed to connect to the fake, so an HTTP client using
+// the transport of s.Client() can be given.
+func (s *Server) Login(options ...mch.LoginOption) (*mch.Client, error) {
+	return mch.Login("user", "password",
+		append([]mch.LoginOption{
+			mch.WithHTTPClient(s.Client()),
+			mch.WithConfigurationURL(s.ConfigurationURL()),
+		}, options...)...)
+}
+
+// Device logs in to the fake, with the given options, and returns its only
+// device.
+func (s *Server) Device(options ...mch.LoginOption) (*mch.Device, error) {
+	client, err := s.Login(options...)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceInfo, err := client.DeviceInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	return deviceInfo.Find(deviceName), nil
+}
+
+// AddDirectory creates a directory, returning its ID.
+func (s *Server) AddDirectory(parentID, name string) string {
+	return s.add(mch.File{ParentID: parentID, Name: name, MimeType: mch.DirectoryMimeType}, nil)
+}
+
+// AddFile creates a regular file with the given content, returning its ID.
+func (s *Server) AddFile(parentID, name string, content []byte) string {
+	return s.add(mch.File{ParentID: parentID, Name: name}, content)
+}
+
+// Content returns the content of a file, and whether the file exists.
+func (s *Server) Content(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), file.content...), true
+}
+
+// Names returns the names of the files in the directory, sorted.
+func (s *Server) Names(parentID string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for _, child := range s.children(parentID) {
+		names = append(names, child.Name)
+	}
+
+	return names
+}
+
+// Stat returns the file with the given path, relative to the root
+// directory, and whether it exists.
+func (s *Server) Stat(path string) (mch.File, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.files[RootID].File
+
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		found := false
+
+		for _, child := range s.children(current.ID) {
+			if child.Name == name {
+				current, found = child, true
+
+				break
+			}
+		}
+
+		if !found {
+			return mch.File{}, false
+		}
+	}
+
+	return current, true
+}
+
+// add stores a new file, filling its ID, ETag and times.
+func (s *Server) add(file mch.File, content []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	file.ID = strconv.Itoa(s.lastID)
+	file.ETag = "1"
+	file.Size = uint64(len(content))
+
+	now := mch.ISOTime(time.Now())
+	if time.Time(file.MTime).IsZero() {
+		file.MTime = now
+	}
+
+	if time.Time(file.CTime).IsZero() {
+		file.CTime = now
+	}
+
+	s.files[file.ID] = &entry{File: file, content: append([]byte(nil), content...)}
+
+	return file.ID
+}
+
+// changed updates the ETag of a file after a change. It must be called
+// holding the lock.
+func (e *entry) changed() {
+	etag, _ := strconv.Atoi(e.ETag)
+	e.ETag = strconv.Itoa(etag + 1)
+	e.Size = uint64(len(e.content))
+}
+
+// checkPrecondition reports whether the If-Match header of the request, if
+// any, matches the file, writing the failure response otherwise. It must be
+// called holding the lock.
+func (e *entry) checkPrecondition(w http.ResponseWriter, r *http.Request) bool {
+	if etag := r.Header.Get("If-Match"); etag != "" && strings.Trim(etag, `"`) != e.ETag {
+		w.WriteHeader(http.StatusPreconditionFailed)
+
+		return false
+	}
+
+	return true
+}
+
+// children returns the files in the directory, sorted by name. As the
+// device doesn't return the files with the same name in any particular
+// order, the newest ones come first, so the clients cannot rely on the
+// first one having the lowest ID. It must be called holding the lock.
+func (s *Server) children(parentID string) []mch.File {
+	var files []mch.File
+
+	for _, file := range s.files {
+		if file.ParentID == parentID && file.ID != RootID {
+			files = append(files, file.File)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Name != files[j].Name {
+			return files[i].Name < files[j].Name
+		}
+
+		return files[i].ID > files[j].ID
+	})
+
+	return files
+}
+
+func (s *Server) serveConfiguration(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": mch.Configuration{
+			ConfigurationID: "mchtest",
+			ComponentMap: map[string]map[string]interface{}{
+				"cloud.service.urls": {
+					"service.auth0.url":  s.URL,
+					"service.device.url": s.URL,
+				},
+			},
+		},
+	})
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	claims := jwt.MapClaims{
+		"sub": userID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(signingKey))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  token,
+		"refresh_token": "mchtest",
+		"id_token":      token,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Hour.Seconds()),
+	})
+}
+
+func (s *Server) serveDeviceInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": []map[string]interface{}{{
+			"deviceId":     deviceName,
+			"name":         deviceName,
+			"mac":          "00:00:c0:ff:ee:00",
+			"serialNumber": "WXA1A23B4567",
+			"network": map[string]interface{}{
+				"localIpAddress":    "127.0.0.1",
+				"externalIpAddress": "203.0.113.1",
+				"internalDNSName":   s.Listener.Addr().String(),
+				"internalURL":       s.URL,
+				"externalURI":       s.URL,
+			},
+		}},
+	})
+}
+
+func (s *Server) serveSearchParents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	files := s.children(query.Get("ids"))
+	s.mu.Unlock()
+
+	start, _ := strconv.Atoi(query.Get("pageToken"))
+	if start > len(files) {
+		start = len(files)
+	}
+
+	files = files[start:]
+	pageToken := ""
+
+	if s.PageSize > 0 && len(files) > s.PageSize {
+		files = files[:s.PageSize]
+		pageToken = strconv.Itoa(start + s.PageSize)
+	}
+
+	writeJSON(w, http.StatusOK, mch.FileList{Files: files, PageToken: pageToken})
+}
+
+func (s *Server) serveSearchParentAndName(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range s.children(query.Get("parentID")) {
+		if file.Name == query.Get("name") {
+			writeJSON(w, http.StatusOK, file)
+
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// serveCreate creates a directory, in response to a POST on /sdk/v2/files,
+// or a file, in response to a POST on /sdk/v2/files/resumable.
+func (s *Server) serveCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	file, err := readMetadata(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	s.mu.Lock()
+	_, found := s.files[file.ParentID]
+	s.mu.Unlock()
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	id := s.add(*file, nil)
+
+	w.Header().Set("Location", "/sdk/v2/files/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// readMetadata decodes the metadata of a new file, which are the JSON
+// document in the first part of a multipart request.
+func readMetadata(r *http.Request) (*mch.File, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := multipart.NewReader(r.Body, params["boundary"]).NextPart()
+	if err != nil {
+		return nil, err
+	}
+
+	var file mch.File
+	if err := json.NewDecoder(part).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// serveFile handles the requests on /sdk/v2/files/{id}, including the
+// writes on /sdk/v2/files/{id}/resumable and the creation of files.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/sdk/v2/files/")
+	if id == "resumable" {
+		s.serveCreate(w, r)
+
+		return
+	}
+
+	id, resumable := trimSuffix(id, "/resumable")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	switch {
+	case resumable && r.Method == http.MethodPost:
+		s.write(w, r, file)
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, file.File)
+	case r.Method == http.MethodPatch:
+		s.patch(w, r, file)
+	case r.Method == http.MethodDelete:
+		s.delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// write changes the content of a file. It must be called holding the lock.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, file *entry) {
+	if !file.checkPrecondition(w, r) {
+		return
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset > len(file.content) {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if r.URL.Query().Get("truncate") == "true" {
+		file.content = file.content[:offset]
+	}
+
+	if end := offset + len(data); end > len(file.content) {
+		file.content = append(file.content, make([]byte, end-len(file.content))...)
+	}
+
+	copy(file.content[offset:], data)
+	file.MTime = mch.ISOTime(time.Now())
+	file.changed()
+
+	w.Header().Set("Etag", `"`+file.ETag+`"`)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patch changes the metadata of a file. It must be called holding the lock.
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, file *entry) {
+	if !file.checkPrecondition(w, r) {
+		return
+	}
+
+	// The content of the request is decoded over the current metadata,
+	// leaving untouched the ones not in the request
+	patched := file.File
+	if err := json.NewDecoder(r.Body).Decode(&patched); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if _, found := s.files[patched.ParentID]; !found {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	patched.ID, patched.ETag, patched.Size = file.ID, file.ETag, file.Size
+	file.File = patched
+	file.changed()
+
+	w.Header().Set("Etag", `"`+file.ETag+`"`)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// delete removes a file, together with its content if it is a directory.
+// It must be called holding the lock.
+func (s *Server) delete(id string) {
+	for _, child := range s.children(id) {
+		s.delete(child.ID)
+	}
+
+	delete(s.files, id)
+}
+
+// serveContent handles the reads on /sdk/v3/files/{id}/content.
+func (s *Server) serveContent(w http.ResponseWriter, r *http.Request) {
+	id, ok := trimSuffix(strings.TrimPrefix(r.URL.Path, "/sdk/v3/files/"), "/content")
+	if !ok || r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	size := len(file.content)
+
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil || end < start {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	w.Header().Set("Etag", `"`+file.ETag+`"`)
+
+	if start >= size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+
+		return
+	}
+
+	if end >= size {
+		end = size - 1
+	}
+
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.WriteHeader(http.StatusPartialContent)
+
+	_, _ = w.Write(file.content[start : end+1])
+}
+
+// trimSuffix removes the suffix from s, reporting whether it was there.
+func trimSuffix(s, suffix string) (string, bool) {
+	if !strings.HasSuffix(s, suffix) {
+		return s, false
+	}
+
+	return strings.TrimSuffix(s, suffix), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(value)
+}
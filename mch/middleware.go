@@ -0,0 +1,360 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Middleware wraps the transport sending the requests of a client, to
+// change them or their responses, or to observe them, e.g. for metrics or
+// tracing.
+//
+// The requests of a client are sent through the middleware added with
+// WithMiddleware, the first one being the outermost, then through the
+// ones of the package, which add the access token and send the requests
+// to the current address of the device, checking the connection to it
+// after errors, and finally through the transport of the HTTP client. The
+// middleware added with WithMiddleware thus don't see the access token in
+// the Authorization header, nor the final address of the device, and
+// sending a request again gets the token refreshed if needed and the
+// request sent to the address the device is reachable at, which changes
+// when it stops or starts being reachable on the local network. They do
+// see, however, the requests obtaining the access token, whose bodies
+// contain the password or the refresh token, so they must never record
+// the bodies of the requests as they are.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is an http.RoundTripper calling a function.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// WithMiddleware adds middleware to the chain sending the requests of the
+// client. It can be used more than once.
+func WithMiddleware(middleware ...Middleware) LoginOption {
+	return func(options *loginOptions) {
+		options.middleware = append(options.middleware, middleware...)
+	}
+}
+
+// chain returns the transport sending the requests of the client through
+// the middleware, and then through the given transport.
+func (c *Client) chain(transport http.RoundTripper, middleware []Middleware) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	transport = checkConnection(transport)
+	transport = c.authorize(transport)
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		transport = middleware[i](transport)
+	}
+
+	return transport
+}
+
+type contextKey int
+
+const requestInfoKey contextKey = iota
+
+// requestInfo describes a request to the package middleware.
+type requestInfo struct {
+	// authorized requests are sent with the access token
+	authorized bool
+
+	// device, if set, is the device receiving the request
+	device *Device
+}
+
+func withRequestInfo(req *http.Request, info requestInfo) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey, info))
+}
+
+func getRequestInfo(req *http.Request) requestInfo {
+	info, _ := req.Context().Value(requestInfoKey).(requestInfo)
+
+	return info
+}
+
+// authorize adds the access token, refreshing it if expired, to the
+// requests created with newAuthorizedRequest or NewAuthorizedRequest.
+func (c *Client) authorize(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if !getRequestInfo(req).authorized {
+			return next.RoundTrip(req)
+		}
+
+		accessToken, err := c.accessToken()
+		if err != nil {
+			closeRequestBody(req)
+
+			return nil, err
+		}
+
+		// A round tripper must not change the request it receives
+		authorized := req.Clone(req.Context())
+		authorized.Header.Set("Authorization", "Bearer "+accessToken)
+
+		return next.RoundTrip(authorized)
+	})
+}
+
+// checkConnection sends the requests for a device to the address it is
+// currently reachable at, and checks whether it is reachable on the local
+// network after a failed request, so the next ones, including the request
+// itself if sent again, go to the right address.
+func checkConnection(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		device := getRequestInfo(req).device
+		if device == nil {
+			return next.RoundTrip(req)
+		}
+
+		base, err := url.Parse(device.DeviceURI())
+		if err != nil {
+			closeRequestBody(req)
+
+			return nil, err
+		}
+
+		// A round tripper must not change the request it receives
+		routed := req.Clone(req.Context())
+		routed.URL.Scheme = base.Scheme
+		routed.URL.Host = base.Host
+		routed.Host = base.Host
+
+		resp, err := next.RoundTrip(routed)
+		if err != nil && device.checkConnectionMode() {
+			return nil, fmt.Errorf("connection mode changed after an error: %w", err)
+		}
+
+		return resp, err
+	})
+}
+
+// closeRequestBody closes the body of a request which is not sent, as the
+// transport would.
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+// Retry returns a middleware sending again the idempotent requests failed
+// with a network error or a 502, 503 or 504 status code, up to the given
+// number of attempts, waiting delay times the number of failed attempts
+// before each new one.
+func Retry(attempts int, delay time.Duration) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent := req
+
+			for attempt := 1; ; attempt++ {
+				resp, err := next.RoundTrip(sent)
+				if attempt >= attempts || !retryable(req, resp, err) {
+					return resp, err
+				}
+
+				if resp != nil {
+					_ = resp.Body.Close()
+				}
+
+				if sent, err = rewind(req); err != nil {
+					return nil, err
+				}
+
+				timer := time.NewTimer(time.Duration(attempt) * delay)
+
+				select {
+				case <-timer.C:
+				case <-req.Context().Done():
+					timer.Stop()
+
+					return nil, req.Context().Err()
+				}
+			}
+		})
+	}
+}
+
+// retryable reports whether the request can be sent again after the
+// given result.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// rewind returns a copy of the request, which has already been sent, with
+// a new copy of the body.
+func rewind(req *http.Request) (*http.Request, error) {
+	sent := req.Clone(req.Context())
+
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+
+		sent.Body = body
+	}
+
+	return sent, nil
+}
+
+// Logging returns a middleware logging every request with logf, e.g.
+// log.Printf, with its result and duration.
+func Logging(logf func(format string, v ...interface{})) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				logf("%v %v: %v (%v)", req.Method, req.URL, err, time.Since(start))
+			} else {
+				logf("%v %v: %v (%v)", req.Method, req.URL, resp.Status, time.Since(start))
+			}
+
+			return resp, err
+		})
+	}
+}
+
+// RateLimit returns a middleware sending the requests at least interval
+// apart.
+func RateLimit(interval time.Duration) Middleware {
+	var (
+		mu   sync.Mutex
+		next time.Time
+	)
+
+	// reserve returns how long to wait before sending the next request
+	reserve := func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if next.Before(now) {
+			next = now
+		}
+
+		wait := next.Sub(now)
+		next = next.Add(interval)
+
+		return wait
+	}
+
+	return func(transport http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			timer := time.NewTimer(reserve())
+
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				closeRequestBody(req)
+
+				return nil, req.Context().Err()
+			}
+
+			return transport.RoundTrip(req)
+		})
+	}
+}
+
+// RequestMetrics describes a request sent through the Metrics middleware.
+type RequestMetrics struct {
+	Method string
+	Host   string
+	Path   string
+	// StatusCode is zero if the request failed without a response
+	StatusCode int
+	Err        error
+	// Duration is the time until the response headers have been received
+	Duration time.Duration
+}
+
+// Metrics returns a middleware calling record after every request, e.g.
+// to update the counters and histograms of a monitoring system.
+func Metrics(record func(RequestMetrics)) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+
+			resp, err := next.RoundTrip(req)
+
+			metrics := RequestMetrics{
+				Method:   req.Method,
+				Host:     req.URL.Host,
+				Path:     req.URL.Path,
+				Err:      err,
+				Duration: time.Since(start),
+			}
+			if resp != nil {
+				metrics.StatusCode = resp.StatusCode
+			}
+
+			record(metrics)
+
+			return resp, err
+		})
+	}
+}
+
+// Tracing returns a middleware tracing the requests with the hooks returned
+// by trace, e.g. to time the DNS lookups, the connections and the TLS
+// handshakes. The hooks are added to the ones already in the context of
+// the request, if any, and trace can return nil to skip a request.
+func Tracing(trace func(req *http.Request) *httptrace.ClientTrace) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if clientTrace := trace(req); clientTrace != nil {
+				req = req.WithContext(httptrace.WithClientTrace(req.Context(), clientTrace))
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
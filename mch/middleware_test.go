@@ -0,0 +1,308 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mch_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/mch/mchfault"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+// requestLog is a middleware keeping track of the requests it sees.
+type requestLog struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (l *requestLog) middleware(next http.RoundTripper) http.RoundTripper {
+	return mch.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		l.mu.Lock()
+		l.requests = append(l.requests, req.Method+" "+req.URL.Path+" "+req.Header.Get("Authorization"))
+		l.mu.Unlock()
+
+		return next.RoundTrip(req)
+	})
+}
+
+// openFile logs in to the server, sending the requests through the given
+// transport and middleware, and returns the file with the given ID.
+func openFile(
+	t *testing.T,
+	server *mchtest.Server,
+	transport http.RoundTripper,
+	id string,
+	middleware ...mch.Middleware,
+) *mch.File {
+	t.Helper()
+
+	client, err := mch.Login("user", "password",
+		mch.WithHTTPClient(&http.Client{Transport: transport}),
+		mch.WithConfigurationURL(server.ConfigurationURL()),
+		mch.WithMiddleware(middleware...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deviceInfo, err := client.DeviceInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := deviceInfo.Find("mchtest").GetFileByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestMiddleware(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	var outer, inner requestLog
+
+	file := openFile(t, server, server.Client().Transport, id, outer.middleware, inner.middleware)
+
+	if err := file.Write([]byte("CONTENT"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"GET /config ",
+		"POST /oauth/token ",
+		"GET /device/v1/user/auth0|mchtest ",
+		"GET /sdk/v2/files/" + id + " ",
+		"POST /sdk/v2/files/" + id + "/resumable ",
+	}
+
+	for _, log := range []*requestLog{&outer, &inner} {
+		if len(log.requests) != len(expected) {
+			t.Fatalf("the middleware saw the requests %q", log.requests)
+		}
+
+		// The access token is added after the middleware
+		for i := range expected {
+			if log.requests[i] != expected[i] {
+				t.Errorf("request %d is %q instead of %q", i, log.requests[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestNewAuthorizedRequest(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	client, err := server.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := client.NewAuthorizedRequest("GET", server.URL+"/sdk/v2/files/"+mchtest.RootID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The request can be sent without the middleware of the client
+	if header := req.Header.Get("Authorization"); header != "Bearer "+client.AccessToken {
+		t.Errorf("the request has the Authorization header %q", header)
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("the request returned %v", resp.Status)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	faults := mchfault.New(1,
+		mchfault.Rule{Path: "/sdk/v2/files/" + id, Times: 2, Fault: mchfault.Fault{Status: http.StatusServiceUnavailable}},
+		mchfault.Rule{Path: "/sdk/v2/files/*/resumable", Times: 1, Fault: mchfault.Fault{Error: true}},
+	)
+	faults.Transport = server.Client().Transport
+
+	// The two failures looking up the file are hidden by the retries
+	file := openFile(t, server, faults, id, mch.Retry(3, time.Millisecond))
+
+	// Writes are not idempotent, so they are not sent again
+	if err := file.Write([]byte("CONTENT"), 0); !errors.Is(err, mchfault.ErrorInjected) {
+		t.Errorf("write with a dropped connection returned %v", err)
+	}
+
+	if err := file.Write([]byte("CONTENT"), 0); err != nil {
+		t.Errorf("write returned %v", err)
+	}
+}
+
+func TestRetryConnectionModeChanged(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	device, err := server.Device(mch.WithMiddleware(mch.Retry(2, time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The device is reachable on the local network
+	if _, err := device.GetFileByID(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device stops being reachable on the local network, so the
+	// request sent again must go to the external address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device.Network.InternalDNSName = listener.Addr().String()
+	_ = listener.Close()
+
+	if _, err := device.GetFileByID(id); err != nil {
+		t.Errorf("the request sent again after the connection mode changed returned %v", err)
+	}
+
+	if uri := device.DeviceURI(); uri != device.Network.ExternalURI {
+		t.Errorf("the device is reached at %v instead of %v", uri, device.Network.ExternalURI)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	const interval = 20 * time.Millisecond
+
+	start := time.Now()
+
+	// Logging in and looking up the file takes four requests
+	openFile(t, server, server.Client().Transport, id, mch.RateLimit(interval))
+
+	if elapsed := time.Since(start); elapsed < 3*interval {
+		t.Errorf("four requests sent in %v", elapsed)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	faults := mchfault.New(1,
+		mchfault.Rule{Path: "/sdk/v2/files/*/resumable", Times: 1, Fault: mchfault.Fault{Error: true}},
+	)
+	faults.Transport = server.Client().Transport
+
+	var (
+		mu      sync.Mutex
+		metrics []mch.RequestMetrics
+	)
+
+	file := openFile(t, server, faults, id, mch.Metrics(func(m mch.RequestMetrics) {
+		mu.Lock()
+		metrics = append(metrics, m)
+		mu.Unlock()
+	}))
+
+	_ = file.Write([]byte("CONTENT"), 0)
+
+	if err := file.Write([]byte("CONTENT"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logging in and looking up the file takes four requests
+	if len(metrics) != 6 {
+		t.Fatalf("recorded %+v", metrics)
+	}
+
+	failed, written := metrics[4], metrics[5]
+	if failed.Method != http.MethodPost || failed.StatusCode != 0 || !errors.Is(failed.Err, mchfault.ErrorInjected) {
+		t.Errorf("recorded %+v for the failed write", failed)
+	}
+
+	if written.Path != "/sdk/v2/files/"+id+"/resumable" || written.StatusCode != http.StatusCreated ||
+		written.Err != nil || written.Duration <= 0 {
+		t.Errorf("recorded %+v for the write", written)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	id := server.AddFile(mchtest.RootID, "file", []byte("content"))
+
+	var (
+		mu     sync.Mutex
+		traced []string
+	)
+
+	// The requests for which trace returns nil are not traced
+	trace := func(req *http.Request) *httptrace.ClientTrace {
+		if req.URL.Path == "/config" {
+			return nil
+		}
+
+		return &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				mu.Lock()
+				traced = append(traced, req.URL.Path)
+				mu.Unlock()
+			},
+		}
+	}
+
+	openFile(t, server, server.Client().Transport, id, mch.Tracing(trace))
+
+	expected := []string{"/oauth/token", "/device/v1/user/auth0|mchtest", "/sdk/v2/files/" + id}
+	if len(traced) != len(expected) {
+		t.Fatalf("traced %q", traced)
+	}
+
+	for i := range expected {
+		if traced[i] != expected[i] {
+			t.Errorf("request %d is %q instead of %q", i, traced[i], expected[i])
+		}
+	}
+}
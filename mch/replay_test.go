@@ -0,0 +1,398 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mch_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/mch/mchrecord"
+	"github.com/mnencia/mchfuse/mch/mchtest"
+)
+
+// The sessions are recorded, in the same format written by the
+// --record-http flag of mchfuse, in two fixtures. The fake-device fixture
+// is recorded against the fake device running
+//
+//	go test ./mch -run TestReplaySession -record
+//
+// and its responses could differ from the ones of a real device in fields
+// the client doesn't use. The real-device fixture is recorded against
+// a device of your account running
+//
+//	MCHFUSE_TEST_USERNAME=user@example.com MCHFUSE_TEST_PASSWORD=... \
+//		go test ./mch -run TestReplaySession -record-device DEVICE_NAME
+//
+// which creates the sessionDir directory in the root of the device, and
+// removes it at the end. No real-device fixture has been recorded yet, so
+// only the fake-device one is replayed until then.
+const (
+	fakeSessionFixture   = "testdata/fake-device-session.json"
+	deviceSessionFixture = "testdata/device-session.json"
+)
+
+// sessionDir is the directory where the session works.
+const sessionDir = "mchfuse-test-session"
+
+const (
+	sessionUsername = "user@example.com"
+	sessionPassword = "secret-password"
+)
+
+// nolint:gochecknoglobals
+var (
+	record       = flag.Bool("record", false, "record the fake-device fixture against the fake device")
+	recordDevice = flag.String("record-device", "",
+		"record the real-device fixture against the device with this name, signing in with the "+
+			"credentials in the MCHFUSE_TEST_USERNAME and MCHFUSE_TEST_PASSWORD environment variables")
+)
+
+func TestReplaySession(t *testing.T) {
+	if *record {
+		recordFakeSession(t)
+	}
+
+	if *recordDevice != "" {
+		recordDeviceSession(t, *recordDevice)
+	}
+
+	t.Run("fake device", func(t *testing.T) {
+		// Only the path of the configuration URL is used replaying
+		replaySession(t, fakeSessionFixture, "https://mchtest.invalid/config")
+	})
+
+	t.Run("real device", func(t *testing.T) {
+		if _, err := os.Stat(deviceSessionFixture); os.IsNotExist(err) {
+			t.Skip("no real-device fixture recorded")
+		}
+
+		replaySession(t, deviceSessionFixture, "")
+	})
+}
+
+// replaySession runs the session replaying the fixture, sending the
+// configuration request to the given URL, or to the default one if empty.
+func replaySession(t *testing.T, fixture string, configurationURL string) {
+	t.Helper()
+
+	replayer, err := mchrecord.Load(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The interactions are the same with every device of the account
+	if err := runSession(&http.Client{Transport: replayer}, configurationURL, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining := replayer.Remaining(); remaining > 0 {
+		t.Errorf("%d recorded interactions not replayed", remaining)
+	}
+}
+
+func TestSessionFixtureRedacted(t *testing.T) {
+	fixture, err := ioutil.ReadFile(fakeSessionFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The identifiers of the fake device are redacted as the real ones
+	secrets := []string{sessionUsername, sessionPassword, "Bearer ey", "WXA1A23B4567", "00:00:c0:ff:ee:00", "203.0.113.1"}
+
+	for _, secret := range secrets {
+		if bytes.Contains(fixture, []byte(secret)) {
+			t.Errorf("the fixture contains %q", secret)
+		}
+	}
+}
+
+func TestRecordLargeBody(t *testing.T) {
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	id := server.AddFile(mchtest.RootID, "large", content)
+
+	var fixture bytes.Buffer
+
+	recorder := mchrecord.NewRecorder(&fixture)
+	recorder.Transport = server.Client().Transport
+	recorder.MaxBodySize = 1024
+
+	file := openFile(t, server, recorder, id)
+
+	// The whole content is received, but only its beginning is recorded
+	buf := make([]byte, len(content))
+
+	n, err := file.Read(buf, 0)
+	if err != nil || !bytes.Equal(buf[:n], content) {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+
+	interactions, err := mchrecord.ReadInteractions(&fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read := interactions[len(interactions)-1]
+	if !strings.HasSuffix(read.Request.URL, "/content") || !read.Response.Truncated ||
+		!bytes.Equal(read.Response.Body, content[:1024]) {
+		t.Errorf("recorded %v with %d bytes, truncated %v",
+			read.Request.URL, len(read.Response.Body), read.Response.Truncated)
+	}
+
+	// The bodies of the device information are recorded entirely
+	for _, interaction := range interactions[:len(interactions)-1] {
+		if interaction.Response.Truncated {
+			t.Errorf("%v truncated", interaction.Request.URL)
+		}
+	}
+}
+
+// recordFakeSession runs the session against the fake device, recording
+// the fake-device fixture.
+func recordFakeSession(t *testing.T) {
+	t.Helper()
+
+	server := mchtest.NewServer()
+	defer server.Close()
+
+	recordSession(t, fakeSessionFixture, server.Client().Transport, server.ConfigurationURL(), "mchtest")
+}
+
+// recordDeviceSession runs the session against the device with the given
+// name, recording the real-device fixture.
+func recordDeviceSession(t *testing.T, deviceName string) {
+	t.Helper()
+
+	username, password := os.Getenv("MCHFUSE_TEST_USERNAME"), os.Getenv("MCHFUSE_TEST_PASSWORD")
+	if username == "" || password == "" {
+		t.Fatal("recording against a real device requires MCHFUSE_TEST_USERNAME and MCHFUSE_TEST_PASSWORD")
+	}
+
+	recordSession(t, deviceSessionFixture, nil, "", deviceName, username, password)
+
+	fixture, err := ioutil.ReadFile(deviceSessionFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{username, password, "Bearer ey"} {
+		if bytes.Contains(fixture, []byte(secret)) {
+			t.Errorf("the real-device fixture contains %q, it must not be committed", secret)
+		}
+	}
+}
+
+// recordSession runs the session through the transport, recording it in
+// the fixture. The credentials are the ones of the session, if not given.
+func recordSession(
+	t *testing.T,
+	fixture string,
+	transport http.RoundTripper,
+	configurationURL string,
+	deviceName string,
+	credentials ...string,
+) {
+	t.Helper()
+
+	recorder, err := mchrecord.Create(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.Transport = transport
+
+	err = runSession(&http.Client{Transport: recorder}, configurationURL, deviceName, credentials...)
+	if closeErr := recorder.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runSession signs in, creates, lists, reads and changes files in
+// sessionDir on the device with the given name, or the first one if
+// empty, checking the results. The configuration is read from the given
+// URL, or from the default one if empty, and the credentials are the
+// ones of the session, if not given.
+func runSession(
+	httpClient *http.Client,
+	configurationURL string,
+	deviceName string,
+	credentials ...string,
+) error {
+	options := []mch.LoginOption{mch.WithHTTPClient(httpClient)}
+	if configurationURL != "" {
+		options = append(options, mch.WithConfigurationURL(configurationURL))
+	}
+
+	username, password := sessionUsername, sessionPassword
+	if len(credentials) == 2 {
+		username, password = credentials[0], credentials[1]
+	}
+
+	client, err := mch.Login(username, password, options...)
+	if err != nil {
+		return err
+	}
+
+	// The files hidden on the device depend on the OS
+	client.Hidden = mch.HiddenNone
+
+	deviceInfo, err := client.DeviceInfo()
+	if err != nil {
+		return err
+	}
+
+	var device *mch.Device
+
+	switch {
+	case deviceName != "":
+		device = deviceInfo.Find(deviceName)
+	case len(deviceInfo.Data) > 0:
+		device = &deviceInfo.Data[0]
+	}
+
+	if device == nil {
+		return fmt.Errorf("device %q not found in %+v", deviceName, deviceInfo.Data)
+	}
+
+	root, err := device.Root()
+	if err != nil {
+		return err
+	}
+
+	// The files of the session are created in a new directory
+	existing, err := root.LookupDirectory(sessionDir)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		return fmt.Errorf("%v already exists on the device, remove it before recording", sessionDir)
+	}
+
+	dir, err := root.CreateDirectory(sessionDir)
+	if err != nil {
+		return err
+	}
+
+	if err := runSessionIn(device, dir); err != nil {
+		_ = dir.DeleteRecursive(nil)
+
+		return err
+	}
+
+	return dir.DeleteRecursive(nil)
+}
+
+// runSessionIn runs the session in the given directory of the device.
+func runSessionIn(device *mch.Device, dir *mch.File) error { // nolint:funlen
+	documents, err := dir.CreateDirectory("Documents")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []struct {
+		parent  *mch.File
+		name    string
+		content []byte
+	}{
+		{dir, "notes.txt", []byte("hello world")},
+		{documents, "report.bin", []byte{0, 1, 2, 0xff}},
+	} {
+		created, err := file.parent.Create(file.name)
+		if err != nil {
+			return err
+		}
+
+		if err := created.Write(file.content, 0); err != nil {
+			return err
+		}
+	}
+
+	files, err := dir.ListDirectory()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for i := range files {
+		names = append(names, files[i].Name)
+	}
+
+	sort.Strings(names)
+
+	if strings.Join(names, ",") != "Documents,notes.txt" {
+		return fmt.Errorf("unexpected listing %v", names)
+	}
+
+	notes, err := dir.LookupDirectory("notes.txt")
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64)
+
+	n, err := notes.Read(buf, 6)
+	if err != nil {
+		return err
+	}
+
+	if string(buf[:n]) != "world" {
+		return fmt.Errorf("read %q", buf[:n])
+	}
+
+	if err := notes.Write([]byte("HELLO"), 0); err != nil {
+		return err
+	}
+
+	report, err := device.GetFileByPath("/" + sessionDir + "/Documents/report.bin")
+	if err != nil {
+		return err
+	}
+
+	if n, err := report.Read(buf, 0); err != nil || !bytes.Equal(buf[:n], []byte{0, 1, 2, 0xff}) {
+		return fmt.Errorf("read %v, %v", buf[:n], err)
+	}
+
+	created, err := dir.Create("new.txt")
+	if err != nil {
+		return err
+	}
+
+	if err := created.Write([]byte("new content"), 0); err != nil {
+		return err
+	}
+
+	if err := created.Rename(dir, "renamed.txt"); err != nil {
+		return err
+	}
+
+	return created.Delete()
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mch
+
+import (
+	"time"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// The device stores the files of the filesystem.
+var _ = (storage.Storage)((*Device)(nil))
+
+// FileInfo returns the information about the file used by the storage
+// interface.
+func (f *File) FileInfo() *storage.FileInfo {
+	return &storage.FileInfo{
+		ID:         f.ID,
+		ETag:       f.ETag,
+		ParentID:   f.ParentID,
+		ChildCount: f.ChildCount,
+		MimeType:   f.MimeType,
+		Name:       f.Name,
+		Size:       f.Size,
+		MTime:      time.Time(f.MTime),
+		CTime:      time.Time(f.CTime),
+	}
+}
+
+// File returns the file of the device described by info.
+func (d *Device) File(info *storage.FileInfo) *File {
+	return &File{
+		ID:         info.ID,
+		ETag:       info.ETag,
+		ParentID:   info.ParentID,
+		ChildCount: info.ChildCount,
+		MimeType:   info.MimeType,
+		Name:       info.Name,
+		Size:       info.Size,
+		MTime:      ISOTime(info.MTime),
+		CTime:      ISOTime(info.CTime),
+		client:     d.client,
+		device:     d,
+	}
+}
+
+// metaJSON returns the request changing the given metadata.
+func metaJSON(meta storage.Meta) map[string]interface{} {
+	reqJSON := make(map[string]interface{})
+
+	if meta.MimeType != "" {
+		reqJSON["mimeType"] = meta.MimeType
+	}
+
+	if !meta.MTime.IsZero() {
+		reqJSON["mTime"] = ISOTime(meta.MTime)
+	}
+
+	if !meta.CTime.IsZero() {
+		reqJSON["cTime"] = ISOTime(meta.CTime)
+	}
+
+	return reqJSON
+}
+
+// requestOptions returns the request options implementing the given
+// storage options.
+func requestOptions(opts []storage.Option) []RequestOption {
+	var requestOpts []RequestOption
+
+	if options := storage.NewOptions(opts...); options.IfMatch != "" {
+		requestOpts = append(requestOpts, IfMatch(options.IfMatch))
+	}
+
+	return requestOpts
+}
+
+func (d *Device) Stat(id string) (*storage.FileInfo, error) {
+	file, err := d.GetFileByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.FileInfo(), nil
+}
+
+func (d *Device) List(dir *storage.FileInfo, pageToken string) ([]storage.FileInfo, string, error) {
+	fileList, err := d.File(dir).ListDirectoryPage(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	files := make([]storage.FileInfo, len(fileList.Files))
+	for i := range fileList.Files {
+		files[i] = *fileList.Files[i].FileInfo()
+	}
+
+	return files, fileList.PageToken, nil
+}
+
+func (d *Device) Lookup(dir *storage.FileInfo, name string) (*storage.FileInfo, error) {
+	file, err := d.File(dir).LookupDirectory(name)
+	if err != nil || file == nil {
+		return nil, err
+	}
+
+	return file.FileInfo(), nil
+}
+
+func (d *Device) Read(info *storage.FileInfo, dest []byte, offset int64) (int, error) {
+	file := d.File(info)
+	n, err := file.Read(dest, offset)
+	info.Size, info.ETag = file.Size, file.ETag
+
+	return n, err
+}
+
+func (d *Device) Write(info *storage.FileInfo, data []byte, offset int64, opts ...storage.Option) error {
+	file := d.File(info)
+	if err := file.Write(data, offset, requestOptions(opts)...); err != nil {
+		return err
+	}
+
+	// The file could have been refreshed before writing
+	*info = *file.FileInfo()
+
+	return nil
+}
+
+func (d *Device) Truncate(info *storage.FileInfo, size int64, opts ...storage.Option) error {
+	file := d.File(info)
+	if err := file.Truncate(size, requestOptions(opts)...); err != nil {
+		return err
+	}
+
+	info.Size, info.ETag = file.Size, file.ETag
+
+	return nil
+}
+
+func (d *Device) Create(dir *storage.FileInfo, name string, meta storage.Meta) (*storage.FileInfo, error) {
+	file, err := d.File(dir).CreateWithMeta(name, metaJSON(meta))
+	if err != nil {
+		return nil, err
+	}
+
+	return file.FileInfo(), nil
+}
+
+func (d *Device) Mkdir(dir *storage.FileInfo, name string) (*storage.FileInfo, error) {
+	file, err := d.File(dir).CreateDirectory(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.FileInfo(), nil
+}
+
+func (d *Device) Rename(info *storage.FileInfo, newParent *storage.FileInfo, newName string) error {
+	return d.File(info).Rename(d.File(newParent), newName)
+}
+
+func (d *Device) Delete(info *storage.FileInfo) error {
+	return d.File(info).Delete()
+}
+
+func (d *Device) SetMeta(info *storage.FileInfo, meta storage.Meta, opts ...storage.Option) error {
+	file := d.File(info)
+	if err := file.SetMeta(metaJSON(meta), requestOptions(opts)...); err != nil {
+		return err
+	}
+
+	info.ETag = file.ETag
+
+	return nil
+}
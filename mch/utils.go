@@ -23,6 +23,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 
@@ -100,3 +101,34 @@ func (mb MultipartBody) AddContentType(req *http.Request) {
 		fmt.Sprintf("multipart/related; boundary=%s", mb.writer.Boundary()),
 	)
 }
+
+// zeroReader is an io.Reader producing an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+// parseContentRangeSize extracts the complete length of the resource from a
+// Content-Range header value, in the form "bytes 0-99/1234" or "bytes */1234".
+func parseContentRangeSize(contentRange string) (uint64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseUint(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return size, true
+}
@@ -52,3 +52,26 @@ func TestISOTimeJSON(t *testing.T) {
 		t.Fatalf("String format for %s does not equal expected %s", string(jsonDate), testString)
 	}
 }
+
+func TestParseContentRangeSize(t *testing.T) {
+	tests := []struct {
+		header string
+		size   uint64
+		ok     bool
+	}{
+		{"bytes 0-99/1234", 1234, true},
+		{"bytes */1234", 1234, true},
+		{"bytes 0-0/1", 1, true},
+		{"bytes 0-99/*", 0, false},
+		{"items 0-99/1234", 0, false},
+		{"", 0, false},
+	}
+
+	for _, test := range tests {
+		size, ok := mch.ParseContentRangeSize(test.header)
+		if size != test.size || ok != test.ok {
+			t.Errorf("ParseContentRangeSize(%q) = %v, %v; expected %v, %v",
+				test.header, size, ok, test.size, test.ok)
+		}
+	}
+}
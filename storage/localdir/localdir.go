@@ -0,0 +1,612 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package localdir implements the storage interface on top of a local
+// directory, to run the filesystem without a My Cloud Home device.
+//
+// The files are identified by their inode number, so their IDs don't change
+// when they are renamed, and their ETag is derived from their size and
+// modification time. The MIME type of the regular files is kept in the
+// user.mime_type extended attribute, when set, or guessed from their
+// extension. Entries which are neither regular files nor directories, like
+// symbolic links, are not listed.
+package localdir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mnencia/mchfuse/storage"
+)
+
+// mimeTypeXattr is the extended attribute storing the MIME type of a file,
+// following the freedesktop.org shared MIME-info specification.
+const mimeTypeXattr = "user.mime_type"
+
+// defaultMimeType is the MIME type of the files with an unknown extension.
+const defaultMimeType = "application/octet-stream"
+
+var (
+	ErrorNotADirectory          = errors.New("not a directory")
+	ErrorMimeTypeNotSupported   = errors.New("storing the MIME type is not supported")
+	ErrorUnsupportedFileType    = errors.New("unsupported file type")
+	ErrorUnexpectedFileMetadata = errors.New("unexpected file metadata")
+)
+
+// Storage is a local directory storing the files.
+type Storage struct {
+	// PageSize is the maximum number of files in a page of a directory
+	// listing. Zero means no limit.
+	PageSize int
+
+	root   string
+	rootID string
+
+	// mu protects locations, which contains where the files seen by the
+	// clients are, so they can be found by ID
+	mu        sync.Mutex
+	locations map[string]location
+
+	// changeMu serializes the changes, so they are applied only if the
+	// file still matches the preconditions
+	changeMu sync.Mutex
+}
+
+// location is the position of a file in the tree.
+type location struct {
+	parentID string
+	name     string
+}
+
+var _ = (storage.Storage)((*Storage)(nil))
+
+// Open returns the storage of the files in the given directory.
+func Open(root string) (*Storage, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%v: %w", root, ErrorNotADirectory)
+	}
+
+	id, err := fileID(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Storage{
+		root:      root,
+		rootID:    id,
+		locations: make(map[string]location),
+	}, nil
+}
+
+// Root returns the directory containing all the files.
+func (s *Storage) Root() (*storage.FileInfo, error) {
+	return s.Stat(s.rootID)
+}
+
+// fileID returns the ID of a file, which is its inode number.
+func fileID(fi os.FileInfo) (string, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("%v: %w", fi.Name(), ErrorUnexpectedFileMetadata)
+	}
+
+	return strconv.FormatUint(uint64(st.Ino), 10), nil
+}
+
+// path returns where the file with the given ID is, as long as it has been
+// returned to the clients and not removed.
+func (s *Storage) path(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+
+	for id != s.rootID {
+		loc, ok := s.locations[id]
+		if !ok {
+			return "", fmt.Errorf("%v: %w", id, storage.ErrorFileNotFound)
+		}
+
+		names = append(names, loc.name)
+		id = loc.parentID
+	}
+
+	p := s.root
+	for i := len(names) - 1; i >= 0; i-- {
+		p = filepath.Join(p, names[i])
+	}
+
+	return p, nil
+}
+
+// info returns the information about the file at the given path, whose
+// parent has the given ID, and keeps track of its location.
+func (s *Storage) info(p string, fi os.FileInfo, parentID string) (*storage.FileInfo, error) {
+	if !fi.IsDir() && !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%v: %w", p, ErrorUnsupportedFileType)
+	}
+
+	id, err := fileID(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &storage.FileInfo{
+		ID:       id,
+		ETag:     etag(fi),
+		ParentID: parentID,
+		Name:     fi.Name(),
+		MTime:    fi.ModTime(),
+		CTime:    changeTime(fi),
+	}
+
+	if fi.IsDir() {
+		info.MimeType = storage.DirectoryMimeType
+	} else {
+		info.MimeType = mimeType(p)
+		info.Size = uint64(fi.Size())
+	}
+
+	if id != s.rootID {
+		s.mu.Lock()
+		s.locations[id] = location{parentID: parentID, name: fi.Name()}
+		s.mu.Unlock()
+	}
+
+	return info, nil
+}
+
+// etag returns a tag which changes when the content of the file changes.
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// updateETag updates the size and the ETag of the file at the given path
+// after a change.
+func updateETag(p string, file *storage.FileInfo) error {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	file.Size, file.ETag = uint64(fi.Size()), etag(fi)
+
+	return nil
+}
+
+// mimeType returns the MIME type stored with the file or, if there is none,
+// the one matching its extension.
+func mimeType(p string) string {
+	if value, ok := getMimeType(p); ok {
+		return value
+	}
+
+	value := mime.TypeByExtension(filepath.Ext(p))
+	if value == "" {
+		return defaultMimeType
+	}
+
+	// Parameters, like the charset, are not part of the type
+	return strings.TrimSpace(strings.SplitN(value, ";", 2)[0])
+}
+
+// checkPrecondition fails if the file at the given path doesn't satisfy the
+// preconditions in the options.
+func checkPrecondition(p string, opts []storage.Option) error {
+	options := storage.NewOptions(opts...)
+	if options.IfMatch == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if etag(fi) != options.IfMatch {
+		return fmt.Errorf("file %v changed: %w", p, storage.ErrorPreconditionFailed)
+	}
+
+	return nil
+}
+
+func (s *Storage) Stat(id string) (*storage.FileInfo, error) {
+	p, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%v: %w", id, storage.ErrorFileNotFound)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The file could have been replaced by a different one
+	if currentID, err := fileID(fi); err != nil || currentID != id {
+		s.mu.Lock()
+		delete(s.locations, id)
+		s.mu.Unlock()
+
+		return nil, fmt.Errorf("%v: %w", id, storage.ErrorFileNotFound)
+	}
+
+	parentID := ""
+	if id != s.rootID {
+		s.mu.Lock()
+		parentID = s.locations[id].parentID
+		s.mu.Unlock()
+	}
+
+	info, err := s.info(p, fi, parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDirectory() {
+		names, err := readDirNames(p)
+		if err != nil {
+			return nil, err
+		}
+
+		info.ChildCount = len(names)
+	}
+
+	return info, nil
+}
+
+// readDirNames returns the names of the entries of the directory, sorted.
+func readDirNames(p string) ([]string, error) {
+	dir, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// List returns the files of the directory sorted by name. The page token is
+// the name of the last file of the previous page.
+func (s *Storage) List(dir *storage.FileInfo, pageToken string) ([]storage.FileInfo, string, error) {
+	p, err := s.path(dir.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	names, err := readDirNames(p)
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := sort.SearchStrings(names, pageToken)
+	if start < len(names) && names[start] == pageToken {
+		start++
+	}
+
+	names = names[start:]
+	nextPageToken := ""
+
+	if s.PageSize > 0 && len(names) > s.PageSize {
+		names = names[:s.PageSize]
+		nextPageToken = names[len(names)-1]
+	}
+
+	files := make([]storage.FileInfo, 0, len(names))
+
+	for _, name := range names {
+		childPath := filepath.Join(p, name)
+
+		fi, err := os.Lstat(childPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		info, err := s.info(childPath, fi, dir.ID)
+		if errors.Is(err, ErrorUnsupportedFileType) {
+			continue
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		files = append(files, *info)
+	}
+
+	return files, nextPageToken, nil
+}
+
+func (s *Storage) Lookup(dir *storage.FileInfo, name string) (*storage.FileInfo, error) {
+	p, err := s.path(dir.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	childPath := filepath.Join(p, name)
+
+	fi, err := os.Lstat(childPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := s.info(childPath, fi, dir.ID)
+	if errors.Is(err, ErrorUnsupportedFileType) {
+		return nil, nil
+	}
+
+	return info, err
+}
+
+func (s *Storage) Read(file *storage.FileInfo, dest []byte, offset int64) (int, error) {
+	p, err := s.path(file.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	file.Size, file.ETag = uint64(fi.Size()), etag(fi)
+
+	if offset >= fi.Size() {
+		return 0, io.EOF
+	}
+
+	n, err := f.ReadAt(dest, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (s *Storage) Write(file *storage.FileInfo, data []byte, offset int64, opts ...storage.Option) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	p, err := s.path(file.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPrecondition(p, opts); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Extending the file fills the gap with zeros, even if there is no
+	// data to write
+	if end := offset + int64(len(data)); end > fi.Size() {
+		if err := f.Truncate(end); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.WriteAt(data, offset); err != nil {
+		return err
+	}
+
+	if fi, err = f.Stat(); err != nil {
+		return err
+	}
+
+	info, err := s.info(p, fi, file.ParentID)
+	if err != nil {
+		return err
+	}
+
+	*file = *info
+
+	return nil
+}
+
+func (s *Storage) Truncate(file *storage.FileInfo, size int64, opts ...storage.Option) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	p, err := s.path(file.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPrecondition(p, opts); err != nil {
+		return err
+	}
+
+	if err := os.Truncate(p, size); err != nil {
+		return err
+	}
+
+	return updateETag(p, file)
+}
+
+func (s *Storage) Create(dir *storage.FileInfo, name string, meta storage.Meta) (*storage.FileInfo, error) {
+	p, err := s.path(dir.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	childPath := filepath.Join(p, name)
+
+	f, err := os.OpenFile(childPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := setMeta(childPath, meta); err != nil {
+		_ = os.Remove(childPath)
+
+		return nil, err
+	}
+
+	return s.Lookup(dir, name)
+}
+
+func (s *Storage) Mkdir(dir *storage.FileInfo, name string) (*storage.FileInfo, error) {
+	p, err := s.path(dir.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Mkdir(filepath.Join(p, name), 0o777); err != nil {
+		return nil, err
+	}
+
+	return s.Lookup(dir, name)
+}
+
+func (s *Storage) Rename(file *storage.FileInfo, newParent *storage.FileInfo, newName string) error {
+	p, err := s.path(file.ID)
+	if err != nil {
+		return err
+	}
+
+	parentPath, err := s.path(newParent.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(p, filepath.Join(parentPath, newName)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.locations[file.ID] = location{parentID: newParent.ID, name: newName}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Storage) Delete(file *storage.FileInfo) error {
+	p, err := s.path(file.ID)
+	if errors.Is(err, storage.ErrorFileNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.locations, file.ID)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *Storage) SetMeta(file *storage.FileInfo, meta storage.Meta, opts ...storage.Option) error {
+	s.changeMu.Lock()
+	defer s.changeMu.Unlock()
+
+	p, err := s.path(file.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := checkPrecondition(p, opts); err != nil {
+		return err
+	}
+
+	if err := setMeta(p, meta); err != nil {
+		return err
+	}
+
+	return updateETag(p, file)
+}
+
+// setMeta changes the metadata of the file at the given path. The creation
+// time cannot be changed, and it is ignored.
+func setMeta(p string, meta storage.Meta) error {
+	if meta.MimeType != "" {
+		if err := setMimeType(p, meta.MimeType); err != nil {
+			return err
+		}
+	}
+
+	if !meta.MTime.IsZero() {
+		// The access time is tracked by the filesystem, and not stored
+		if err := os.Chtimes(p, time.Now(), meta.MTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
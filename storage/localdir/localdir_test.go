@@ -0,0 +1,218 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdir_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mnencia/mchfuse/storage"
+	"github.com/mnencia/mchfuse/storage/localdir"
+)
+
+func openStorage(t *testing.T) (string, *localdir.Storage, *storage.FileInfo) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "localdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	s, err := localdir.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := s.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, s, root
+}
+
+func TestReadWrite(t *testing.T) {
+	dir, s, root := openStorage(t)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	file, err := s.Create(root, "file.html", storage.Meta{MTime: mtime})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !file.MTime.Equal(mtime) || file.MimeType != "text/html" || file.ParentID != root.ID {
+		t.Errorf("unexpected file %+v", file)
+	}
+
+	// Writing past the end fills the gap with zeros
+	if err := s.Write(file, []byte("data"), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Size != 6 {
+		t.Errorf("size is %v instead of 6", file.Size)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "file.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != "\x00\x00data" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	buf := make([]byte, 10)
+
+	n, err := s.Read(file, buf, 3)
+	if err != nil || string(buf[:n]) != "ata" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+
+	if _, err := s.Read(file, buf, 6); !errors.Is(err, io.EOF) {
+		t.Errorf("read at the end returned %v instead of EOF", err)
+	}
+}
+
+func TestPrecondition(t *testing.T) {
+	_, s, root := openStorage(t)
+
+	file, err := s.Create(root, "file", storage.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	etag := file.ETag
+
+	if err := s.Write(file, []byte("first"), 0, storage.IfMatch(etag)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Write(file, []byte("second"), 0, storage.IfMatch(etag))
+	if !errors.Is(err, storage.ErrorPreconditionFailed) {
+		t.Errorf("write with stale ETag returned %v", err)
+	}
+
+	if err := s.SetMeta(file, storage.Meta{MTime: time.Now()}, storage.IfMatch(file.ETag)); err != nil {
+		t.Errorf("set meta with current ETag returned %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	_, s, root := openStorage(t)
+	s.PageSize = 2
+
+	for _, name := range []string{"c", "a", "d", "b", "e"} {
+		if _, err := s.Create(root, name, storage.Meta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+
+	pages := 0
+	pageToken := ""
+
+	for {
+		files, next, err := s.List(root, pageToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range files {
+			names = append(names, files[i].Name)
+		}
+
+		pages++
+
+		if next == "" {
+			break
+		}
+
+		pageToken = next
+	}
+
+	if pages != 3 || len(names) != 5 || names[0] != "a" || names[4] != "e" {
+		t.Errorf("listed %v in %v pages", names, pages)
+	}
+
+	stat, err := s.Stat(root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.ChildCount != 5 {
+		t.Errorf("child count is %v instead of 5", stat.ChildCount)
+	}
+}
+
+func TestRenameAndDelete(t *testing.T) {
+	_, s, root := openStorage(t)
+
+	dir, err := s.Mkdir(root, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := s.Create(dir, "file", storage.Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := s.Mkdir(root, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ID of a file doesn't change when its directory is renamed
+	if err := s.Rename(dir, other, "moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := storage.LookupPath(s, root, "/other/moved/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.ID != file.ID {
+		t.Errorf("file has ID %v instead of %v after rename", found.ID, file.ID)
+	}
+
+	if _, err := s.Stat(file.ID); err != nil {
+		t.Errorf("stat after rename returned %v", err)
+	}
+
+	if err := s.Delete(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Stat(file.ID); !errors.Is(err, storage.ErrorFileNotFound) {
+		t.Errorf("stat after delete returned %v", err)
+	}
+
+	if info, err := s.Lookup(root, "other"); info != nil || err != nil {
+		t.Errorf("lookup after delete returned %v, %v", info, err)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdir
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// maxMimeTypeLen is the size of the buffer used to read the MIME types.
+const maxMimeTypeLen = 256
+
+// changeTime returns the last time the metadata of the file changed.
+func changeTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+
+	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec)) // nolint:unconvert
+}
+
+// getMimeType returns the MIME type stored with the file, if any.
+func getMimeType(p string) (string, bool) {
+	buf := make([]byte, maxMimeTypeLen)
+
+	n, err := syscall.Getxattr(p, mimeTypeXattr, buf)
+	if err != nil || n <= 0 {
+		return "", false
+	}
+
+	return string(buf[:n]), true
+}
+
+// setMimeType stores the MIME type with the file.
+func setMimeType(p string, mimeType string) error {
+	return syscall.Setxattr(p, mimeTypeXattr, []byte(mimeType), 0)
+}
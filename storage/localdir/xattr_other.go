@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdir
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// changeTime returns the last time the metadata of the file changed. The
+// modification time is used, as the change time is not portable.
+func changeTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
+
+// getMimeType returns the MIME type stored with the file, which is never
+// available on this platform.
+func getMimeType(p string) (string, bool) {
+	return "", false
+}
+
+// setMimeType fails, as storing MIME types is not supported on this
+// platform.
+func setMimeType(p string, mimeType string) error {
+	return fmt.Errorf("%v: %w", p, ErrorMimeTypeNotSupported)
+}
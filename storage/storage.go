@@ -0,0 +1,169 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package storage defines the interface between the filesystem and the
+// service storing the files. It is implemented by the My Cloud Home devices
+// of the mch package, and can be implemented by fakes, caches or wrappers.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DirectoryMimeType is the MIME type of the directories.
+const DirectoryMimeType = "application/x.wd.dir"
+
+var (
+	ErrorFileNotFound       = errors.New("file not found")
+	ErrorPreconditionFailed = errors.New("precondition failed")
+	ErrorWriteGapTooBig     = errors.New("write gap too big")
+	ErrorInvalidPath        = errors.New("invalid path")
+)
+
+// FileInfo is the information about a file or a directory.
+type FileInfo struct {
+	ID         string
+	ETag       string
+	ParentID   string
+	ChildCount int
+	MimeType   string
+	Name       string
+	Size       uint64
+	MTime      time.Time
+	CTime      time.Time
+}
+
+func (fi *FileInfo) IsDirectory() bool {
+	return fi.MimeType == DirectoryMimeType
+}
+
+// Meta contains the metadata to set on a file. The zero values are left
+// unchanged.
+type Meta struct {
+	MimeType string
+	MTime    time.Time
+	CTime    time.Time
+}
+
+// Option changes how a change to a file is applied.
+type Option func(options *Options)
+
+// Options are the settings of a change to a file.
+type Options struct {
+	// IfMatch, if not empty, is the ETag the file must have for the change
+	// to be applied. The change fails with ErrorPreconditionFailed otherwise.
+	IfMatch string
+}
+
+// IfMatch makes the change fail if the file has a different ETag. An empty
+// etag is ignored.
+func IfMatch(etag string) Option {
+	return func(options *Options) {
+		options.IfMatch = etag
+	}
+}
+
+// NewOptions returns the settings resulting from the given options.
+func NewOptions(opts ...Option) Options {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// Storage is where the files are stored. The FileInfo passed to the
+// methods are the ones returned by the same storage.
+type Storage interface {
+	// Stat returns the file with the given ID, or an error wrapping
+	// ErrorFileNotFound if there is no such file.
+	Stat(id string) (*FileInfo, error)
+
+	// List returns a page of the content of the directory. The first page
+	// is returned for an empty token, and the returned token is the one of
+	// the next page, or empty if this is the last one. Names are not
+	// guaranteed to be unique or valid on a POSIX filesystem.
+	List(dir *FileInfo, pageToken string) ([]FileInfo, string, error)
+
+	// Lookup returns the child of the directory with the given name, or nil
+	// if the directory has no such child.
+	Lookup(dir *FileInfo, name string) (*FileInfo, error)
+
+	// Read reads up to len(dest) bytes starting at offset. It returns io.EOF
+	// when offset is at or beyond the end of the file. The Size and ETag of
+	// the file are updated with the current ones.
+	Read(file *FileInfo, dest []byte, offset int64) (int, error)
+
+	// Write writes data at the given offset. If the offset is past the end
+	// of the file, the hole is filled with zeros. The file is updated with
+	// the new size and ETag, which is empty if the storage doesn't return
+	// it after the change.
+	Write(file *FileInfo, data []byte, offset int64, opts ...Option) error
+
+	// Truncate changes the size of the file. The file is updated like
+	// with Write.
+	Truncate(file *FileInfo, size int64, opts ...Option) error
+
+	// Create creates an empty file in the directory, with the given
+	// metadata.
+	Create(dir *FileInfo, name string, meta Meta) (*FileInfo, error)
+
+	// Mkdir creates an empty directory in the directory.
+	Mkdir(dir *FileInfo, name string) (*FileInfo, error)
+
+	// Rename moves the file to the newParent directory with the newName.
+	Rename(file *FileInfo, newParent *FileInfo, newName string) error
+
+	// Delete removes the file. Directories are removed with their content.
+	Delete(file *FileInfo) error
+
+	// SetMeta changes the metadata of the file. The ETag of the file is
+	// updated like with Write.
+	SetMeta(file *FileInfo, meta Meta, opts ...Option) error
+}
+
+// LookupPath returns the file with the given path, relative to the dir
+// directory.
+func LookupPath(s Storage, dir *FileInfo, path string) (*FileInfo, error) {
+	current := dir
+
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if !current.IsDirectory() {
+			return nil, fmt.Errorf("path component %s is not a directory: %w", current.Name, ErrorInvalidPath)
+		}
+
+		next, err := s.Lookup(current, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if next == nil {
+			return nil, fmt.Errorf("path component %s not found: %w", name, ErrorInvalidPath)
+		}
+
+		current = next
+	}
+
+	return current, nil
+}
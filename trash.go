@@ -0,0 +1,134 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mnencia/mchfuse/trash"
+)
+
+const trashCommand = "trash"
+
+// runTrashCommand manages the content of the trash folder of a device.
+// The args are the device name followed by a subcommand and its arguments.
+func runTrashCommand(config config, args []string) {
+	if len(args) < 2 {
+		config.printUsage()
+		os.Exit(1)
+	}
+
+	if config.Trash == "" {
+		log.Fatalf("Trash folder is required. Set it in configuration file or specify it with --trash flag.\n")
+	}
+
+	device := connect(config, args[0])
+
+	trashFolder, err := trash.Open(device, config.Trash)
+	if err != nil {
+		log.Fatalf("Failure opening trash folder %s: %s", config.Trash, err)
+	}
+
+	switch command, params := args[1], args[2:]; command {
+	case "list":
+		listTrash(trashFolder)
+	case "restore":
+		restoreTrash(trashFolder, params)
+	case "purge":
+		purgeTrash(trashFolder, params)
+	default:
+		config.printUsage()
+		os.Exit(1)
+	}
+}
+
+func listTrash(trashFolder *trash.Trash) {
+	entries, err := trashFolder.List()
+	if err != nil {
+		log.Fatalf("Failure listing trash: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "DELETED\tNAME\tORIGIN")
+
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n",
+			entry.DeletionDate.Format("2006-01-02 15:04:05"), entry.Name, entry.OriginPath)
+	}
+
+	_ = w.Flush()
+}
+
+func restoreTrash(trashFolder *trash.Trash, names []string) {
+	if len(names) == 0 {
+		log.Fatalf("Specify the names of the trash entries to restore.\n")
+	}
+
+	for _, name := range names {
+		entry, err := trashFolder.Find(name)
+		if err != nil {
+			log.Fatalf("Failure restoring %s: %s", name, err)
+		}
+
+		if err := trashFolder.Restore(entry); err != nil {
+			log.Fatalf("Failure restoring %s: %s", name, err)
+		}
+
+		fmt.Printf("Restored %s to %s\n", name, entry.OriginPath)
+	}
+}
+
+func purgeTrash(trashFolder *trash.Trash, params []string) {
+	var age time.Duration
+
+	if len(params) > 0 {
+		var err error
+		if age, err = parseAge(params[0]); err != nil {
+			log.Fatalf("Failed to parse age: '%v'\n", err)
+		}
+	}
+
+	purged, err := trashFolder.Purge(age)
+	for _, entry := range purged {
+		fmt.Printf("Purged %s\n", entry.Name)
+	}
+
+	if err != nil {
+		log.Fatalf("Failure purging trash: %s", err)
+	}
+}
+
+// parseAge parses a duration, accepting also a number of days with
+// the "d" suffix (e.g. "30d").
+func parseAge(value string) (time.Duration, error) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		intVal, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(intVal) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
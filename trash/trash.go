@@ -0,0 +1,351 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package trash implements a recycle bin on a My Cloud Home device.
+//
+// The layout of the trash folder follows the freedesktop.org trash
+// specification: the deleted entries are moved inside the `files`
+// subdirectory, and for each of them a `.trashinfo` file is created inside
+// the `info` subdirectory, recording the original path and the deletion date.
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mnencia/mchfuse/mch"
+	"github.com/mnencia/mchfuse/storage"
+)
+
+const (
+	filesDir       = "files"
+	infoDir        = "info"
+	infoSuffix     = ".trashinfo"
+	infoHeader     = "[Trash Info]"
+	infoDateLayout = "2006-01-02T15:04:05"
+
+	// timestampLayout is the format of the deletion timestamp prepended to
+	// the names of the entries, which keeps them unique.
+	timestampLayout = "20060102T150405.000000000"
+)
+
+var (
+	ErrorNotFound     = errors.New("entry not found in trash")
+	ErrorTargetExists = errors.New("restore target already exists")
+	ErrorInvalidInfo  = errors.New("invalid trash info")
+)
+
+// Trash is a folder on the device where the deleted files are moved to.
+type Trash struct {
+	device *mch.Device
+	root   *mch.File
+	files  *mch.File
+	info   *mch.File
+
+	// deviceRootID is the ID of the root directory of the device
+	deviceRootID string
+}
+
+// Entry is a file or directory inside the trash.
+type Entry struct {
+	// Name is the name of the entry inside the trash
+	Name string
+	// OriginPath is the path on the device the entry has been deleted from
+	OriginPath string
+	// OriginParentID is the ID of the directory the entry has been deleted from
+	OriginParentID string
+	// DeletionDate is the time the entry has been moved to the trash
+	DeletionDate time.Time
+	file         *mch.File
+	infoFile     *mch.File
+}
+
+// Open returns the trash stored in the folder with the given path on the
+// device, creating it if it doesn't exist.
+func Open(device *mch.Device, trashPath string) (*Trash, error) {
+	root, err := device.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	deviceRootID := root.ID
+
+	for _, name := range strings.Split(strings.Trim(trashPath, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if root, err = lookupOrCreateDirectory(root, name); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &Trash{device: device, root: root, deviceRootID: deviceRootID}
+
+	if t.files, err = lookupOrCreateDirectory(root, filesDir); err != nil {
+		return nil, err
+	}
+
+	if t.info, err = lookupOrCreateDirectory(root, infoDir); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func lookupOrCreateDirectory(parent *mch.File, name string) (*mch.File, error) {
+	dir, err := parent.LookupDirectory(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == nil {
+		return parent.CreateDirectory(name)
+	}
+
+	if !dir.IsDirectory() {
+		return nil, fmt.Errorf("trash path component %s is not a directory: %w", name, mch.ErrorInvalidOperation)
+	}
+
+	return dir, nil
+}
+
+// Contains reports whether the directory with the given ID is inside the
+// trash folder, including the directories moved to the trash. Files
+// deleted from there must not be moved to the trash again.
+func (t *Trash) Contains(dirID string) bool {
+	for id := dirID; id != "" && id != t.deviceRootID; {
+		if id == t.root.ID || id == t.files.ID || id == t.info.ID {
+			return true
+		}
+
+		dir, err := t.device.GetFileByID(id)
+		if err != nil {
+			// The file is moved to the trash, where it can be recovered from
+			log.Printf("Error checking whether the directory %s is in the trash: %v", id, err)
+
+			return false
+		}
+
+		id = dir.ParentID
+	}
+
+	return false
+}
+
+// Put moves the file to the trash, recording that it was located at
+// originPath.
+func (t *Trash) Put(fileInfo *storage.FileInfo, originPath string) error {
+	file := t.device.File(fileInfo)
+	now := time.Now()
+	name := now.UTC().Format(timestampLayout) + "-" + file.Name
+
+	info := fmt.Sprintf("%s\nPath=%s\nDeletionDate=%s\nX-MCHFuse-ParentID=%s\n",
+		infoHeader, originPath, now.Format(infoDateLayout), file.ParentID)
+
+	infoFile, err := t.info.Create(name + infoSuffix)
+	if err != nil {
+		return err
+	}
+
+	if err := infoFile.Write([]byte(info), 0); err != nil {
+		_ = infoFile.Delete()
+
+		return err
+	}
+
+	if err := file.Rename(t.files, name); err != nil {
+		_ = infoFile.Delete()
+
+		return err
+	}
+
+	return nil
+}
+
+// List returns the entries in the trash, ordered by deletion date.
+func (t *Trash) List() ([]Entry, error) {
+	files, err := t.files.ListDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	infoList, err := t.info.ListDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	infoFiles := make(map[string]mch.File, len(infoList))
+	for _, infoFile := range infoList {
+		infoFiles[infoFile.Name] = infoFile
+	}
+
+	entries := make([]Entry, 0, len(files))
+
+	for _, file := range files {
+		// Pin the variable
+		file := file
+		name := file.Name
+		entry := Entry{Name: name, file: &file}
+
+		// Entries without a valid info file only know their deletion date
+		if infoFile, found := infoFiles[name+infoSuffix]; found {
+			entry.infoFile = &infoFile
+
+			if err := readInfo(&entry); err != nil {
+				log.Printf("Ignoring the info of trash entry %s: %v", name, err)
+
+				entry.OriginPath, entry.OriginParentID, entry.DeletionDate = "", "", time.Time{}
+			}
+		}
+
+		if entry.DeletionDate.IsZero() && len(name) > len(timestampLayout) {
+			entry.DeletionDate, _ = time.Parse(timestampLayout, name[:len(timestampLayout)])
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletionDate.Before(entries[j].DeletionDate)
+	})
+
+	return entries, nil
+}
+
+func readInfo(entry *Entry) error {
+	data := make([]byte, entry.infoFile.Size)
+
+	n, err := entry.infoFile.Read(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	lines := strings.Split(string(data[:n]), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != infoHeader {
+		return fmt.Errorf("%s: %w", entry.infoFile.Name, ErrorInvalidInfo)
+	}
+
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "Path":
+			entry.OriginPath = kv[1]
+		case "DeletionDate":
+			if date, err := time.ParseInLocation(infoDateLayout, kv[1], time.Local); err == nil {
+				entry.DeletionDate = date
+			}
+		case "X-MCHFuse-ParentID":
+			entry.OriginParentID = kv[1]
+		}
+	}
+
+	return nil
+}
+
+// Find returns the entry with the given name.
+func (t *Trash) Find(name string) (*Entry, error) {
+	entries, err := t.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if entries[i].Name == name {
+			return &entries[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s: %w", name, ErrorNotFound)
+}
+
+// Restore moves the entry back where it was deleted from. If the original
+// parent directory doesn't exist anymore, the original path is used.
+func (t *Trash) Restore(entry *Entry) error {
+	if entry.OriginPath == "" {
+		return fmt.Errorf("%s has no origin path: %w", entry.Name, ErrorInvalidInfo)
+	}
+
+	parent, err := t.device.GetFileByID(entry.OriginParentID)
+	if entry.OriginParentID == "" || err != nil {
+		if parent, err = t.device.GetFileByPath(path.Dir(entry.OriginPath)); err != nil {
+			return err
+		}
+	}
+
+	name := path.Base(entry.OriginPath)
+
+	existing, err := parent.LookupDirectory(name)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		return fmt.Errorf("%s: %w", entry.OriginPath, ErrorTargetExists)
+	}
+
+	if err := entry.file.Rename(parent, name); err != nil {
+		return err
+	}
+
+	if entry.infoFile != nil {
+		return entry.infoFile.Delete()
+	}
+
+	return nil
+}
+
+// Purge permanently deletes the entries which have been in the trash for
+// longer than the given age, returning the purged ones.
+func (t *Trash) Purge(age time.Duration) ([]Entry, error) {
+	entries, err := t.List()
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make([]Entry, 0, len(entries))
+	limit := time.Now().Add(-age)
+
+	for _, entry := range entries {
+		if entry.DeletionDate.After(limit) {
+			continue
+		}
+
+		if err := entry.file.Delete(); err != nil {
+			return purged, err
+		}
+
+		if entry.infoFile != nil {
+			if err := entry.infoFile.Delete(); err != nil {
+				return purged, err
+			}
+		}
+
+		purged = append(purged, entry)
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trash_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mnencia/mchfuse/mch/mchtest"
+	"github.com/mnencia/mchfuse/trash"
+)
+
+const oldEntry = "20200101T000000.000000000-old"
+
+// openTrash returns the trash of a new server, which contains the old entry
+// without info file, and the file "dir/new" moved there by the trash.
+func openTrash(t *testing.T) (*mchtest.Server, *trash.Trash) {
+	t.Helper()
+
+	server := mchtest.NewServer()
+
+	device, err := server.Device()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashFolder, err := trash.Open(device, "/.trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := server.Stat("/.trash/files")
+	server.AddFile(files.ID, oldEntry, []byte("old"))
+
+	dirID := server.AddDirectory(mchtest.RootID, "dir")
+
+	file, err := device.GetFileByID(server.AddFile(dirID, "new", []byte("new")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := trashFolder.Put(file.FileInfo(), "/dir/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	return server, trashFolder
+}
+
+// newEntry returns the entry of the file moved to the trash by openTrash.
+func newEntry(t *testing.T, trashFolder *trash.Trash) *trash.Entry {
+	t.Helper()
+
+	entries, err := trashFolder.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Name != oldEntry {
+		t.Fatalf("trash contains %v", entries)
+	}
+
+	return &entries[1]
+}
+
+func TestList(t *testing.T) {
+	server, trashFolder := openTrash(t)
+	defer server.Close()
+
+	entry := newEntry(t, trashFolder)
+	if entry.OriginPath != "/dir/new" || time.Since(entry.DeletionDate) > time.Minute {
+		t.Errorf("the new entry is %+v", entry)
+	}
+
+	// An invalid info file leaves the entry with the date in its name
+	info, _ := server.Stat("/.trash/info")
+	server.AddFile(info.ID, oldEntry+".trashinfo", []byte("invalid"))
+
+	entries, err := trashFolder.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].OriginPath != "" || entries[0].DeletionDate.Year() != 2020 {
+		t.Errorf("trash contains %+v", entries)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		err      error
+		content  string
+		left     int
+	}{
+		{name: "restored", content: "new", left: 1},
+		{name: "target exists", existing: true, err: trash.ErrorTargetExists, content: "replacement", left: 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			server, trashFolder := openTrash(t)
+			defer server.Close()
+
+			dir, _ := server.Stat("/dir")
+			if tt.existing {
+				server.AddFile(dir.ID, "new", []byte("replacement"))
+			}
+
+			entry := newEntry(t, trashFolder)
+			if err := trashFolder.Restore(entry); !errors.Is(err, tt.err) {
+				t.Fatalf("restore returned %v", err)
+			}
+
+			restored, _ := server.Stat("/dir/new")
+			if content, _ := server.Content(restored.ID); string(content) != tt.content {
+				t.Errorf("/dir/new contains %q", content)
+			}
+
+			if entries, _ := trashFolder.List(); len(entries) != tt.left {
+				t.Errorf("trash contains %+v", entries)
+			}
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		name     string
+		age      time.Duration
+		purgeOld bool
+		purgeNew bool
+	}{
+		{name: "everything", age: 0, purgeOld: true, purgeNew: true},
+		{name: "older than a day", age: 24 * time.Hour, purgeOld: true},
+		{name: "nothing", age: 100 * 365 * 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			server, trashFolder := openTrash(t)
+			defer server.Close()
+
+			var expected []string
+			if tt.purgeOld {
+				expected = append(expected, oldEntry)
+			}
+
+			if newName := newEntry(t, trashFolder).Name; tt.purgeNew {
+				expected = append(expected, newName)
+			}
+
+			purged, err := trashFolder.Purge(tt.age)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(purged) != len(expected) {
+				t.Fatalf("purged %+v", purged)
+			}
+
+			for i, entry := range purged {
+				if entry.Name != expected[i] {
+					t.Errorf("purged %s instead of %s", entry.Name, expected[i])
+				}
+			}
+
+			if entries, _ := trashFolder.List(); len(entries) != 2-len(expected) {
+				t.Errorf("trash contains %+v", entries)
+			}
+
+			// The info files are purged with the entries
+			info, _ := server.Stat("/.trash/info")
+			if names := server.Names(info.ID); tt.purgeNew && len(names) != 0 {
+				t.Errorf("info files left: %v", names)
+			}
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	server, trashFolder := openTrash(t)
+	defer server.Close()
+
+	files, _ := server.Stat("/.trash/files")
+	trashedID := server.AddDirectory(files.ID, "20200101T000000.000000000-dir")
+	nestedID := server.AddDirectory(trashedID, "nested")
+	dir, _ := server.Stat("/dir")
+
+	tests := map[string]bool{
+		mchtest.RootID: false,
+		dir.ID:         false,
+		files.ID:       true,
+		trashedID:      true,
+		nestedID:       true,
+	}
+
+	for id, expected := range tests {
+		if contained := trashFolder.Contains(id); contained != expected {
+			t.Errorf("the trash contains %v: %v instead of %v", id, contained, expected)
+		}
+	}
+}
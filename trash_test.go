@@ -0,0 +1,52 @@
+/*
+Copyright 2020 Marco Nenciarini <mnencia@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		value string
+		age   time.Duration
+		valid bool
+	}{
+		{value: "30d", age: 30 * 24 * time.Hour, valid: true},
+		{value: "0d", age: 0, valid: true},
+		{value: "36h", age: 36 * time.Hour, valid: true},
+		{value: "90m", age: 90 * time.Minute, valid: true},
+		{value: "d"},
+		{value: "1.5d"},
+		{value: "30"},
+		{value: "week"},
+	}
+
+	for _, tt := range tests {
+		age, err := parseAge(tt.value)
+
+		switch {
+		case tt.valid && err != nil:
+			t.Errorf("parseAge(%q) returned %v", tt.value, err)
+		case !tt.valid && err == nil:
+			t.Errorf("parseAge(%q) returned %v instead of an error", tt.value, age)
+		case age != tt.age:
+			t.Errorf("parseAge(%q) returned %v instead of %v", tt.value, age, tt.age)
+		}
+	}
+}